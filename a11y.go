@@ -0,0 +1,151 @@
+// Accessibility checks (a11y)
+package main
+
+import (
+	"golang.org/x/net/html"
+	"strconv"
+	"strings"
+)
+
+// Input types that do not require a label.
+var unlabeledInputs = map[string]bool{"hidden": true, "submit": true, "reset": true, "button": true, "image": true}
+
+// Accessibility logs an a11y entry, along with the DOM path
+// of the element, for each of the following found in a page:
+//   img:            img tag without an alt attribute
+//   link-text:      empty or image only a tag without accessible text
+//   label:          form input, select or textarea without a label
+//   lang:           html tag without a lang attribute
+//   heading:        heading that skips one or more levels
+//   duplicate-link: same link text pointing to different URLs
+func (ls *Links) Accessibility(root *html.Node) {
+	// Gather the ids referenced by label tags, and the
+	// elements of each id, first; as labels may come after
+	// the inputs they refer to, and aria-labelledby may
+	// refer to elements after the link.
+	labels := make(map[string]bool)
+	ids := make(map[string]*html.Node)
+	walkHtml(root, nil, false, func(n *html.Node, _ []string) {
+		if n.Data == "label" {
+			if id := getAttr(n, "for"); id != "" {
+				labels[id] = true
+			}
+		}
+		if id := getAttr(n, "id"); id != "" && ids[id] == nil {
+			ids[id] = n
+		}
+	})
+	var level int
+	links := make(map[string]string)
+	walkHtml(root, nil, ls.nthchild, func(n *html.Node, locs []string) {
+		loc := strings.Join(append(locs, locName(n, ls.nthchild)), "/")
+		switch n.Data {
+		case "html":
+			if !hasAttr(n, "lang") {
+				ls.a11y(loc, "lang", "Missing lang attribute")
+			}
+		case "img":
+			if !hasAttr(n, "alt") {
+				ls.a11y(loc, "img", "Missing alt attribute")
+			}
+		case "a":
+			if !hasAttr(n, "href") {
+				break
+			}
+			text := accessibleText(n, ids)
+			if text == "" {
+				ls.a11y(loc, "link-text", "Link without accessible text")
+				break
+			}
+			href := getAttr(n, "href")
+			if li, err := ls.canon(ls.LinkInfo, href); err == nil {
+				href = li.String() + li.Query
+			}
+			key := strings.ToLower(text)
+			if prev, ok := links[key]; !ok {
+				links[key] = href
+			} else if prev != href {
+				ls.a11y(loc, "duplicate-link", "Link text '"+text+"' points to '"+prev+"' and '"+href+"'")
+			}
+		case "input", "select", "textarea":
+			if n.Data == "input" && unlabeledInputs[strings.ToLower(getAttr(n, "type"))] {
+				break
+			}
+			if !labels[getAttr(n, "id")] && !hasAttr(n, "aria-label") && labelledBy(n, ids) == "" && !hasAttr(n, "title") && !hasAncestor(n, "label") {
+				ls.a11y(loc, "label", "Form control without a label")
+			}
+		case "h1", "h2", "h3", "h4", "h5", "h6":
+			l := int(n.Data[1] - '0')
+			if level > 0 && l > level+1 {
+				ls.a11y(loc, "heading", "Heading "+n.Data+" follows h"+strconv.Itoa(level))
+			}
+			level = l
+		}
+	})
+}
+
+func (ls *Links) a11y(loc string, check string, msg string) {
+	ls.log.Warn("a11y", "src", ls.source, "url", ls.String(), "tag", loc, "check", check, "err", msg)
+}
+
+// accessibleText returns the text a screen reader would
+// announce for an element; i.e. the text of the elements
+// its aria-labelledby refers to, or its aria-label, or its
+// text content including image alt text, or its title.
+func accessibleText(n *html.Node, ids map[string]*html.Node) string {
+	if text := labelledBy(n, ids); text != "" {
+		return text
+	}
+	if label := strings.TrimSpace(getAttr(n, "aria-label")); label != "" {
+		return label
+	}
+	if text := contentText(n); text != "" {
+		return text
+	}
+	return strings.TrimSpace(getAttr(n, "title"))
+}
+
+// labelledBy returns the text content of the elements whose
+// ids are listed in the aria-labelledby attribute, joined by
+// spaces; ids without an element in the page are skipped.
+func labelledBy(n *html.Node, ids map[string]*html.Node) string {
+	var text []string
+	for _, id := range strings.Fields(getAttr(n, "aria-labelledby")) {
+		if ref, ok := ids[id]; ok {
+			if t := contentText(ref); t != "" {
+				text = append(text, t)
+			}
+		}
+	}
+	return strings.Join(text, " ")
+}
+
+// contentText returns the text content of an element,
+// including image alt text, with whitespace collapsed.
+func contentText(n *html.Node) string {
+	var text []string
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.TextNode {
+			text = append(text, n.Data)
+		} else if n.Type == html.ElementNode && n.Data == "img" {
+			text = append(text, getAttr(n, "alt"))
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(n)
+	return strings.Join(strings.Fields(strings.Join(text, " ")), " ")
+}
+
+// hasAncestor returns true if the node is contained
+// within an element with the given tag name.
+func hasAncestor(n *html.Node, tag string) bool {
+	for p := n.Parent; p != nil; p = p.Parent {
+		if p.Type == html.ElementNode && p.Data == tag {
+			return true
+		}
+	}
+	return false
+}
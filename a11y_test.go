@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/html"
+)
+
+// a11yChecks returns the check and err of each a11y entry
+// logged for a page.
+func a11yChecks(t *testing.T, page string) []string {
+	root, err := html.Parse(bytes.NewReader([]byte(page)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ls := testLinks(t, "https://www.txstate.edu/")
+	tl := &testLog{}
+	ls.log = tl.logger()
+	ls.Accessibility(root)
+	var checks []string
+	for _, ctx := range tl.find("a11y") {
+		checks = append(checks, ctx["check"].(string)+": "+ctx["err"].(string))
+	}
+	return checks
+}
+
+func testA11y(t *testing.T, tests []struct {
+	body   string
+	checks []string
+}) {
+	for _, test := range tests {
+		checks := a11yChecks(t, `<html lang="en"><body>`+test.body+`</body></html>`)
+		if strings.Join(checks, "\n") != strings.Join(test.checks, "\n") {
+			t.Errorf("%s:\n%s\nwant:\n%s", test.body, strings.Join(checks, "\n"), strings.Join(test.checks, "\n"))
+		}
+	}
+}
+
+func TestA11yLang(t *testing.T) {
+	if checks := a11yChecks(t, `<html><body><p>Hi</p></body></html>`); strings.Join(checks, "\n") != "lang: Missing lang attribute" {
+		t.Errorf("checks %q", checks)
+	}
+	if checks := a11yChecks(t, `<html lang="en"><body><p>Hi</p></body></html>`); len(checks) != 0 {
+		t.Errorf("checks %q", checks)
+	}
+}
+
+func TestA11yImg(t *testing.T) {
+	testA11y(t, []struct {
+		body   string
+		checks []string
+	}{
+		{`<img src="/logo.png">`, []string{"img: Missing alt attribute"}},
+		{`<img src="/spacer.gif" alt="">`, nil},
+		{`<img src="/logo.png" alt="Texas State">`, nil},
+	})
+}
+
+func TestA11yLinkText(t *testing.T) {
+	testA11y(t, []struct {
+		body   string
+		checks []string
+	}{
+		{`<a href="/about">About</a>`, nil},
+		{`<a href="/about"></a>`, []string{"link-text: Link without accessible text"}},
+		{`<a href="/about"><img src="/i.png" alt=""></a>`, []string{"link-text: Link without accessible text"}},
+		{`<a href="/about"><img src="/i.png" alt="About"></a>`, nil},
+		{`<a href="/about" aria-label="About us"></a>`, nil},
+		{`<a href="/about" title="About us"></a>`, nil},
+		{`<a name="top"></a>`, nil},
+		// aria-labelledby refers to elements, whose text counts.
+		{`<a href="/about" aria-labelledby="label"></a><span id="label">About us</span>`, nil},
+		{`<a href="/about" aria-labelledby="label"></a><span id="label"> </span>`, []string{"link-text: Link without accessible text"}},
+		{`<a href="/about" aria-labelledby="missing"></a>`, []string{"link-text: Link without accessible text"}},
+		{`<a href="/about" aria-labelledby="missing">About</a>`, nil},
+	})
+}
+
+func TestA11yLabel(t *testing.T) {
+	testA11y(t, []struct {
+		body   string
+		checks []string
+	}{
+		{`<input name="q">`, []string{"label: Form control without a label"}},
+		{`<input id="q" name="q"><label for="q">Search</label>`, nil},
+		{`<label>Search <input name="q"></label>`, nil},
+		{`<input type="hidden" name="token"><input type="submit" value="Go">`, nil},
+		{`<select name="s" aria-label="Campus"></select>`, nil},
+		{`<textarea name="c" aria-labelledby="c-label"></textarea><span id="c-label">Comments</span>`, nil},
+		{`<textarea name="c" aria-labelledby="missing"></textarea>`, []string{"label: Form control without a label"}},
+	})
+}
+
+func TestA11yHeading(t *testing.T) {
+	testA11y(t, []struct {
+		body   string
+		checks []string
+	}{
+		{`<h1>A</h1><h2>B</h2><h3>C</h3><h2>D</h2><h1>E</h1><h2>F</h2>`, nil},
+		{`<h1>A</h1><h3>B</h3>`, []string{"heading: Heading h3 follows h1"}},
+		{`<h2>A</h2><h4>B</h4><h5>C</h5>`, []string{"heading: Heading h4 follows h2"}},
+	})
+}
+
+func TestA11yDuplicateLink(t *testing.T) {
+	testA11y(t, []struct {
+		body   string
+		checks []string
+	}{
+		{`<a href="/news">More</a><a href="/news">more</a>`, nil},
+		{`<a href="/news">More</a><a href="/events">More</a>`, []string{"duplicate-link: Link text 'More' points to 'https://www.txstate.edu/news' and 'https://www.txstate.edu/events'"}},
+		// Announced text is compared, not aria-labelledby ids.
+		{`<span id="a">Details</span><span id="b">Details</span><a href="/news" aria-labelledby="a"></a><a href="/events" aria-labelledby="b"></a>`, []string{"duplicate-link: Link text 'Details' points to 'https://www.txstate.edu/news' and 'https://www.txstate.edu/events'"}},
+		{`<span id="a">News</span><span id="b">Events</span><a href="/news" aria-labelledby="x a"></a><a href="/events" aria-labelledby="x b"></a>`, nil},
+	})
+}
@@ -0,0 +1,504 @@
+// Record and replay of http traffic as WARC/HAR archives (archive)
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/textproto"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+type ErrNotArchived struct {
+	url string
+}
+
+func (e ErrNotArchived) Error() string {
+	return fmt.Sprintf("Not in replay archive: '%s'", e.url)
+}
+
+type ErrArchive struct {
+	line string
+}
+
+func (e ErrArchive) Error() string {
+	return fmt.Sprintf("Not a WARC record: '%s'", e.line)
+}
+
+// Request and response headers whose values are not written
+// to archives; so that credentials and session cookies are
+// not leaked.
+var redacted = map[string]bool{
+	"Authorization":       true,
+	"Proxy-Authorization": true,
+	"Cookie":              true,
+	"Set-Cookie":          true,
+}
+
+// Recorder writes every request and response made by thrawler
+// into a WARC file, or a HAR file if the file name ends with
+// .har, so that a strange failure may be looked into after
+// staging changes, or the crawl replayed. Response bodies are
+// recorded as transferred, up to max bytes; larger bodies are
+// truncated and marked as such. It is shared by all threads;
+// a nil Recorder records nothing.
+type Recorder struct {
+	mu  sync.Mutex
+	f   *os.File
+	w   *bufio.Writer
+	har bool
+	n   int
+	max int64
+}
+
+// NewRecorder creates the archive file; or returns
+// nil if no file is given.
+func NewRecorder(file string, max int64) (*Recorder, error) {
+	if file == "" {
+		return nil, nil
+	}
+	f, err := os.Create(file)
+	if err != nil {
+		return nil, err
+	}
+	r := &Recorder{f: f, w: bufio.NewWriter(f), har: strings.HasSuffix(strings.ToLower(file), ".har"), max: max}
+	if r.har {
+		_, err = r.w.WriteString(`{"log":{"version":"1.2","creator":{"name":"thrawler","version":"1"},"pages":[],"entries":[`)
+	} else {
+		info := "software: thrawler\r\nformat: WARC File Format 1.0\r\n"
+		err = r.warcRecord("warcinfo", warcId(), "", "application/warc-fields", "", []byte(info), false)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// Close completes and closes the archive file.
+func (r *Recorder) Close() error {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.har {
+		r.w.WriteString("\n]}}\n")
+	}
+	if err := r.w.Flush(); err != nil {
+		r.f.Close()
+		return err
+	}
+	return r.f.Close()
+}
+
+// Transport wraps the base transport so that
+// its requests and responses are recorded.
+func (r *Recorder) Transport(base http.RoundTripper) http.RoundTripper {
+	if r == nil {
+		return base
+	}
+	return recordTransport{base: base, rec: r}
+}
+
+type recordTransport struct {
+	base http.RoundTripper
+	rec  *Recorder
+}
+
+func (t recordTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	res, err := t.base.RoundTrip(req)
+	if err != nil {
+		return res, err
+	}
+	res.Body = &recordBody{ReadCloser: res.Body, rec: t.rec, req: req, res: res, start: start}
+	return res, nil
+}
+
+// recordBody captures a response body as it is read, and
+// records the exchange once the body is closed.
+type recordBody struct {
+	io.ReadCloser
+	rec       *Recorder
+	req       *http.Request
+	res       *http.Response
+	start     time.Time
+	buf       bytes.Buffer
+	eof       bool
+	truncated bool
+	once      sync.Once
+}
+
+func (b *recordBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if room := b.rec.max - int64(b.buf.Len()); b.rec.max <= 0 || int64(n) <= room {
+		b.buf.Write(p[:n])
+	} else {
+		if room > 0 {
+			b.buf.Write(p[:room])
+		}
+		b.truncated = true
+	}
+	if err == io.EOF {
+		b.eof = true
+	}
+	return n, err
+}
+
+func (b *recordBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(func() {
+		// Bodies closed before they were completely read,
+		// such as those of ranged existence checks, are
+		// also marked as truncated.
+		truncated := b.truncated || (!b.eof && b.req.Method != "HEAD" && b.res.ContentLength != 0)
+		b.rec.record(b.req, b.res, b.buf.Bytes(), truncated, time.Since(b.start), b.start)
+	})
+	return err
+}
+
+func (r *Recorder) record(req *http.Request, res *http.Response, body []byte, truncated bool, total time.Duration, start time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.har {
+		r.harEntry(req, res, body, truncated, total, start)
+		return
+	}
+	var reqBlock bytes.Buffer
+	fmt.Fprintf(&reqBlock, "%s %s HTTP/1.1\r\nHost: %s\r\n", req.Method, req.URL.RequestURI(), req.URL.Host)
+	writeHeaders(&reqBlock, req.Header)
+	reqBlock.WriteString("\r\n")
+	id := warcId()
+	r.warcRecord("request", id, req.URL.String(), "application/http;msgtype=request", "", reqBlock.Bytes(), false)
+	var resBlock bytes.Buffer
+	fmt.Fprintf(&resBlock, "%s %s\r\n", res.Proto, res.Status)
+	writeHeaders(&resBlock, res.Header)
+	resBlock.WriteString("\r\n")
+	resBlock.Write(body)
+	r.warcRecord("response", warcId(), req.URL.String(), "application/http;msgtype=response", id, resBlock.Bytes(), truncated)
+}
+
+func writeHeaders(w io.Writer, h http.Header) {
+	for name, vals := range h {
+		for _, v := range vals {
+			if redacted[http.CanonicalHeaderKey(name)] {
+				v = "REDACTED"
+			}
+			fmt.Fprintf(w, "%s: %s\r\n", name, v)
+		}
+	}
+}
+
+func warcId() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return fmt.Sprintf("<urn:uuid:%x-%x-%x-%x-%x>", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+func (r *Recorder) warcRecord(kind string, id string, uri string, content string, concurrent string, block []byte, truncated bool) error {
+	fmt.Fprintf(r.w, "WARC/1.0\r\nWARC-Type: %s\r\nWARC-Record-ID: %s\r\nWARC-Date: %s\r\n", kind, id, time.Now().UTC().Format(time.RFC3339))
+	if uri != "" {
+		fmt.Fprintf(r.w, "WARC-Target-URI: %s\r\n", uri)
+	}
+	if concurrent != "" {
+		fmt.Fprintf(r.w, "WARC-Concurrent-To: %s\r\n", concurrent)
+	}
+	if truncated {
+		r.w.WriteString("WARC-Truncated: length\r\n")
+	}
+	fmt.Fprintf(r.w, "Content-Type: %s\r\nContent-Length: %d\r\n\r\n", content, len(block))
+	r.w.Write(block)
+	_, err := r.w.WriteString("\r\n\r\n")
+	return err
+}
+
+type harHeader struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harContent struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	Encoding string `json:"encoding,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+type harRequest struct {
+	Method      string        `json:"method"`
+	URL         string        `json:"url"`
+	HTTPVersion string        `json:"httpVersion"`
+	Headers     []harHeader   `json:"headers"`
+	QueryString []harHeader   `json:"queryString"`
+	Cookies     []interface{} `json:"cookies"`
+	HeadersSize int           `json:"headersSize"`
+	BodySize    int           `json:"bodySize"`
+}
+
+type harResponse struct {
+	Status      int           `json:"status"`
+	StatusText  string        `json:"statusText"`
+	HTTPVersion string        `json:"httpVersion"`
+	Headers     []harHeader   `json:"headers"`
+	Cookies     []interface{} `json:"cookies"`
+	Content     harContent    `json:"content"`
+	RedirectURL string        `json:"redirectURL"`
+	HeadersSize int           `json:"headersSize"`
+	BodySize    int           `json:"bodySize"`
+}
+
+type harEntry struct {
+	StartedDateTime string             `json:"startedDateTime"`
+	Time            float64            `json:"time"`
+	Request         harRequest         `json:"request"`
+	Response        harResponse        `json:"response"`
+	Cache           struct{}           `json:"cache"`
+	Timings         map[string]float64 `json:"timings"`
+}
+
+func harHeaders(h http.Header) []harHeader {
+	hs := []harHeader{}
+	for name, vals := range h {
+		for _, v := range vals {
+			if redacted[http.CanonicalHeaderKey(name)] {
+				v = "REDACTED"
+			}
+			hs = append(hs, harHeader{Name: name, Value: v})
+		}
+	}
+	return hs
+}
+
+// harEntry writes an exchange as a HAR entry. HAR content is
+// the decoded body; so compressed bodies are decoded first.
+func (r *Recorder) harEntry(req *http.Request, res *http.Response, body []byte, truncated bool, total time.Duration, start time.Time) {
+	if enc := res.Header.Get("Content-Encoding"); enc != "" {
+		decoded := http.Response{Header: http.Header{"Content-Encoding": {enc}}, Body: ioutil.NopCloser(bytes.NewReader(body))}
+		if b, _, _, err := (Bodies{}).Read(&decoded); err == nil || len(b) > 0 {
+			body = b
+		}
+	}
+	e := harEntry{
+		StartedDateTime: start.UTC().Format(time.RFC3339Nano),
+		Time:            ms(total),
+		Request: harRequest{
+			Method:      req.Method,
+			URL:         req.URL.String(),
+			HTTPVersion: "HTTP/1.1",
+			Headers:     harHeaders(req.Header),
+			QueryString: []harHeader{},
+			Cookies:     []interface{}{},
+			HeadersSize: -1,
+			BodySize:    -1,
+		},
+		Response: harResponse{
+			Status:      res.StatusCode,
+			StatusText:  strings.TrimSpace(strings.TrimPrefix(res.Status, strconv.Itoa(res.StatusCode))),
+			HTTPVersion: res.Proto,
+			Headers:     harHeaders(res.Header),
+			Cookies:     []interface{}{},
+			Content:     harContent{Size: len(body), MimeType: res.Header.Get("Content-Type")},
+			RedirectURL: res.Header.Get("Location"),
+			HeadersSize: -1,
+			BodySize:    -1,
+		},
+		Timings: map[string]float64{"send": 0, "wait": ms(total), "receive": 0},
+	}
+	for name, vals := range req.URL.Query() {
+		for _, v := range vals {
+			e.Request.QueryString = append(e.Request.QueryString, harHeader{Name: name, Value: v})
+		}
+	}
+	if utf8.Valid(body) {
+		e.Response.Content.Text = string(body)
+	} else {
+		e.Response.Content.Text = base64.StdEncoding.EncodeToString(body)
+		e.Response.Content.Encoding = "base64"
+	}
+	if truncated {
+		e.Response.Content.Comment = "truncated"
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	if r.n > 0 {
+		r.w.WriteString(",")
+	}
+	r.w.WriteString("\n")
+	r.w.Write(b)
+	r.n++
+}
+
+type archived struct {
+	status     int
+	statusText string
+	header     http.Header
+	body       []byte
+}
+
+// Replay is a transport serving responses from a WARC or HAR
+// archive recorded by an earlier crawl instead of the network;
+// so that extraction and canonicalization changes may be re-run
+// offline against a frozen snapshot. Requests missing from the
+// archive fail with ErrNotArchived.
+type Replay struct {
+	entries map[string]*archived
+}
+
+// NewReplay loads the archive file; or
+// returns nil if no file is given.
+func NewReplay(file string) (*Replay, error) {
+	if file == "" {
+		return nil, nil
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := &Replay{entries: make(map[string]*archived)}
+	if strings.HasSuffix(strings.ToLower(file), ".har") {
+		err = r.loadHar(f)
+	} else {
+		err = r.loadWarc(f)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Later entries replace earlier ones for the same request;
+// e.g. the successful retry of a failed request.
+func (r *Replay) add(method string, url string, a *archived) {
+	r.entries[method+" "+url] = a
+}
+
+func (r *Replay) loadWarc(in io.Reader) error {
+	br := bufio.NewReader(in)
+	tp := textproto.NewReader(br)
+	methods := make(map[string]string)
+	for {
+		line, err := tp.ReadLine()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if line == "" {
+			continue
+		}
+		if !strings.HasPrefix(line, "WARC/") {
+			return ErrArchive{line: line}
+		}
+		h, err := tp.ReadMIMEHeader()
+		if err != nil {
+			return err
+		}
+		n, err := strconv.Atoi(h.Get("Content-Length"))
+		if err != nil {
+			return err
+		}
+		block := make([]byte, n)
+		if _, err := io.ReadFull(br, block); err != nil {
+			return err
+		}
+		switch h.Get("WARC-Type") {
+		case "request":
+			if sp := bytes.IndexByte(block, ' '); sp > 0 {
+				methods[h.Get("WARC-Record-ID")] = string(block[:sp])
+			}
+		case "response":
+			method, ok := methods[h.Get("WARC-Concurrent-To")]
+			if !ok {
+				method = "GET"
+			}
+			res, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(block)), &http.Request{Method: method})
+			if err != nil {
+				return err
+			}
+			// Truncated bodies end before their Content-Length.
+			body, _ := ioutil.ReadAll(res.Body)
+			res.Body.Close()
+			r.add(method, h.Get("WARC-Target-URI"), &archived{status: res.StatusCode, statusText: res.Status, header: res.Header, body: body})
+		}
+	}
+}
+
+func (r *Replay) loadHar(in io.Reader) error {
+	var har struct {
+		Log struct {
+			Entries []harEntry `json:"entries"`
+		} `json:"log"`
+	}
+	if err := json.NewDecoder(in).Decode(&har); err != nil {
+		return err
+	}
+	for _, e := range har.Log.Entries {
+		a := &archived{status: e.Response.Status, statusText: strconv.Itoa(e.Response.Status) + " " + e.Response.StatusText, header: make(http.Header)}
+		for _, h := range e.Response.Headers {
+			a.header.Add(h.Name, h.Value)
+		}
+		// HAR content is decoded; so it is served as is.
+		a.header.Del("Content-Encoding")
+		a.body = []byte(e.Response.Content.Text)
+		if e.Response.Content.Encoding == "base64" {
+			b, err := base64.StdEncoding.DecodeString(e.Response.Content.Text)
+			if err != nil {
+				return err
+			}
+			a.body = b
+		}
+		r.add(e.Request.Method, e.Request.URL, a)
+	}
+	return nil
+}
+
+// RoundTrip serves the archived response of the request. HEAD
+// requests may be served from an archived GET response, and
+// ranged GET existence checks from an archived HEAD response.
+func (r *Replay) RoundTrip(req *http.Request) (*http.Response, error) {
+	url := req.URL.String()
+	a, ok := r.entries[req.Method+" "+url]
+	if !ok && req.Method == "HEAD" {
+		a, ok = r.entries["GET "+url]
+	} else if !ok && req.Method == "GET" && req.Header.Get("Range") != "" {
+		a, ok = r.entries["HEAD "+url]
+	}
+	if !ok {
+		return nil, ErrNotArchived{url: url}
+	}
+	res := &http.Response{
+		Status:        a.statusText,
+		StatusCode:    a.status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        cloneHeader(a.header),
+		Body:          ioutil.NopCloser(bytes.NewReader(a.body)),
+		ContentLength: int64(len(a.body)),
+		Request:       req,
+	}
+	if req.Method == "HEAD" {
+		res.Body = ioutil.NopCloser(bytes.NewReader(nil))
+		res.ContentLength = -1
+		if n, err := strconv.ParseInt(a.header.Get("Content-Length"), 10, 64); err == nil {
+			res.ContentLength = n
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Credentials and session cookies are redacted from recorded
+// exchanges, logins are not recorded at all, and the archive
+// replays the recorded responses.
+func TestRecordRedactsAndReplays(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/login" {
+			http.SetCookie(w, &http.Cookie{Name: "JSESSIONID", Value: "login-session-secret"})
+			http.Redirect(w, r, "/", 302)
+			return
+		}
+		http.SetCookie(w, &http.Cookie{Name: "tracker", Value: "page-cookie-secret"})
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, "<html><body>page</body></html>")
+	}))
+	defer ts.Close()
+	dir, err := ioutil.TempDir("", "thrawler-archive-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"crawl.warc", "crawl.har"} {
+		file := filepath.Join(dir, name)
+		envs := testEnvs(t, ".")
+		if envs.recorder, err = NewRecorder(file, 0); err != nil {
+			t.Fatal(err)
+		}
+		if envs.jar, err = NewJar(""); err != nil {
+			t.Fatal(err)
+		}
+		logins := Logins{{url: ts.URL + "/login", fields: url.Values{"mgnlUserPSWD": {"password-secret"}}}}
+		if err := logins.Login((&testLog{}).logger(), envs); err != nil {
+			t.Fatal(err)
+		}
+		req, _ := http.NewRequest("GET", ts.URL+"/page", nil)
+		req.Header.Set("Authorization", "Basic auth-secret")
+		res, err := envs.NewClient().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err := envs.recorder.Close(); err != nil {
+			t.Fatal(err)
+		}
+		archive, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, secret := range []string{"secret", "/login"} {
+			if strings.Contains(string(archive), secret) {
+				t.Errorf("%s: archive contains %q", name, secret)
+			}
+		}
+		if !strings.Contains(string(archive), "REDACTED") {
+			t.Errorf("%s: archive has no redacted headers", name)
+		}
+		replay, err := NewReplay(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err = (&http.Client{Transport: replay}).Get(ts.URL + "/page")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if string(body) != "<html><body>page</body></html>" {
+			t.Errorf("%s: replayed %q", name, body)
+		}
+	}
+}
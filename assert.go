@@ -0,0 +1,97 @@
+// Per-URL content assertions (assert)
+package main
+
+import (
+	"github.com/andybalholm/cascadia"
+	"golang.org/x/net/html"
+	log "gopkg.in/inconshreveable/log15.v2"
+	"regexp"
+	"strings"
+	"sync/atomic"
+)
+
+type Assert struct {
+	url  *regexp.Regexp
+	kind string
+	re   *regexp.Regexp
+	sel  cascadia.Selector
+	rule string
+}
+
+// Asserts is the list of content assertions made on html
+// pages whose url matches the assertion's url regular
+// expression. They are declared in the [assert] section of
+// the config file as tab delimited url regexp, kind and
+// value entries, where kind is one of:
+//   contains	body must match the regexp value
+//   excludes	body must not match the regexp value
+//   selector	document must contain an element matching the css selector value
+//   noselector	document must not contain an element matching the css selector value
+// Failed assertions are counted so that thrawler exits
+// with a non-zero status.
+type Asserts struct {
+	rules  []Assert
+	failed *int64
+}
+
+func (as *Asserts) Parse(fields []string) error {
+	if len(fields) != 3 {
+		return ErrConfigFile{line: strings.Join(fields, "\t")}
+	}
+	url, err := regexp.Compile(fields[0])
+	if err != nil {
+		return err
+	}
+	a := Assert{url: url, kind: fields[1], rule: fields[1] + ":" + fields[2]}
+	switch a.kind {
+	case "contains", "excludes":
+		if a.re, err = regexp.Compile(fields[2]); err != nil {
+			return err
+		}
+	case "selector", "noselector":
+		if a.sel, err = cascadia.Compile(fields[2]); err != nil {
+			return err
+		}
+	default:
+		return ErrConfigFile{line: strings.Join(fields, "\t")}
+	}
+	if as.failed == nil {
+		as.failed = new(int64)
+	}
+	as.rules = append(as.rules, a)
+	return nil
+}
+
+// Check evaluates all assertions matching the page url
+// against its body and parsed document, logging an
+// assert entry for each failed assertion.
+func (as Asserts) Check(l log.Logger, src string, url string, body []byte, root *html.Node) {
+	for _, a := range as.rules {
+		if !a.url.MatchString(url) {
+			continue
+		}
+		var ok bool
+		switch a.kind {
+		case "contains":
+			ok = a.re.Match(body)
+		case "excludes":
+			ok = !a.re.Match(body)
+		case "selector":
+			ok = a.sel.MatchFirst(root) != nil
+		case "noselector":
+			ok = a.sel.MatchFirst(root) == nil
+		}
+		if !ok {
+			atomic.AddInt64(as.failed, 1)
+			l.Error("assert", "src", src, "url", url, "rule", a.rule)
+		}
+	}
+}
+
+// Failed returns the number of failed assertions.
+func (as Asserts) Failed() int64 {
+	if as.failed == nil {
+		return 0
+	}
+	return atomic.LoadInt64(as.failed)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/html"
+)
+
+func TestAssertsCheck(t *testing.T) {
+	var as Asserts
+	if as.Failed() != 0 {
+		t.Errorf("Failed() = %d without assertions", as.Failed())
+	}
+	for _, entry := range []string{
+		"/news/\tcontains\tUpdated [0-9]{4}",
+		".\texcludes\tException in thread",
+		"^https://www.txstate.edu/\tselector\tdiv#main h1",
+		".\tnoselector\tdiv.debug",
+	} {
+		if err := as.Parse(strings.Split(entry, "\t")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		url    string
+		body   string
+		failed []string
+	}{
+		{"https://www.txstate.edu/news/", `<div id="main"><h1>News</h1>Updated 2016</div>`, nil},
+		{"https://www.txstate.edu/news/", `<div id="main"><h1>News</h1></div>`, []string{"contains:Updated [0-9]{4}"}},
+		{"https://www.txstate.edu/about", `<div id="main"><h1>About</h1></div>`, nil},
+		{"https://www.txstate.edu/about", `<div id="main"><h2>About</h2></div>`, []string{"selector:div#main h1"}},
+		{"https://gato.txstate.edu/about", `<div id="main"><h2>About</h2></div>`, nil},
+		{"https://gato.txstate.edu/error", `<pre>Exception in thread "main"</pre><div class="debug"></div>`, []string{"excludes:Exception in thread", "noselector:div.debug"}},
+	}
+	var total int64
+	for _, test := range tests {
+		root, err := html.Parse(bytes.NewReader([]byte(test.body)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		tl := &testLog{}
+		as.Check(tl.logger(), "https://www.txstate.edu/", test.url, []byte(test.body), root)
+		var failed []string
+		for _, ctx := range tl.find("assert") {
+			if ctx["url"] != test.url {
+				t.Errorf("assert entry url %v, want %s", ctx["url"], test.url)
+			}
+			failed = append(failed, ctx["rule"].(string))
+		}
+		if strings.Join(failed, "\n") != strings.Join(test.failed, "\n") {
+			t.Errorf("%s %s failed %q, want %q", test.url, test.body, failed, test.failed)
+		}
+		total += int64(len(test.failed))
+	}
+	if as.Failed() != total {
+		t.Errorf("Failed() = %d, want %d", as.Failed(), total)
+	}
+}
+
+func TestAssertsParse(t *testing.T) {
+	for _, entry := range []string{
+		"/news/\tcontains",
+		"(unclosed\tcontains\tx",
+		".\tcontains\t(unclosed",
+		".\tselector\tdiv[",
+		".\tmatches\tx",
+	} {
+		var as Asserts
+		if err := as.Parse(strings.Split(entry, "\t")); err == nil {
+			t.Errorf("Parse(%q) accepted", entry)
+		}
+	}
+}
@@ -0,0 +1,428 @@
+// Authentication of protected staging and author sites (auth)
+package main
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	log "gopkg.in/inconshreveable/log15.v2"
+	"hash"
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+type ErrCredential struct {
+	ref string
+}
+
+func (e ErrCredential) Error() string {
+	return "Credential must be env:NAME or file:path referring to a user:password value: '" + e.ref + "'"
+}
+
+type ErrLogin struct {
+	url  string
+	code int
+}
+
+func (e ErrLogin) Error() string {
+	return fmt.Sprintf("Login to '%s' failed with status %d", e.url, e.code)
+}
+
+// Credential reads a user:password pair from the environment
+// variable or the first line of the file it refers to; so
+// that passwords are kept off of the command line and out
+// of config files. The reclinks.sh $magusr variable may be
+// used as is, e.g. env:magusr
+func Credential(ref string) (string, string, error) {
+	var val string
+	switch {
+	case strings.HasPrefix(ref, "env:"):
+		val = os.Getenv(ref[4:])
+	case strings.HasPrefix(ref, "file:"):
+		f, err := os.Open(ref[5:])
+		if err != nil {
+			return "", "", err
+		}
+		in := bufio.NewScanner(f)
+		if in.Scan() {
+			val = strings.TrimSpace(in.Text())
+		}
+		f.Close()
+	}
+	up := strings.SplitN(val, ":", 2)
+	if len(up) != 2 || up[0] == "" {
+		return "", "", ErrCredential{ref: ref}
+	}
+	return up[0], up[1], nil
+}
+
+type Auth struct {
+	re     *regexp.Regexp
+	scheme string
+	user   string
+	pass   string
+	// Last digest challenge of the matching hosts; so
+	// following requests authenticate without a 401.
+	mu   sync.Mutex
+	chal map[string]string
+	nc   int
+}
+
+// Auths are the basic and digest credentials sent to urls
+// matching a regexp. They are declared in the [auth] section
+// of the config file as tab delimited regexp, scheme and
+// credential entries; the first matching entry is used:
+//   ^https://gato-staging-docs\.its\.txstate\.edu/	basic	env:STAGEUSR
+//   ^http://localhost:8080/	digest	file:/etc/thrawler/magnolia
+type Auths []*Auth
+
+func (as *Auths) Parse(fields []string) error {
+	if len(fields) != 3 || (fields[1] != "basic" && fields[1] != "digest") {
+		return ErrConfigFile{line: strings.Join(fields, "\t")}
+	}
+	re, err := regexp.Compile(fields[0])
+	if err != nil {
+		return err
+	}
+	user, pass, err := Credential(fields[2])
+	if err != nil {
+		return err
+	}
+	*as = append(*as, &Auth{re: re, scheme: fields[1], user: user, pass: pass})
+	return nil
+}
+
+func (as Auths) match(u string) *Auth {
+	for _, a := range as {
+		if a.re.MatchString(u) {
+			return a
+		}
+	}
+	return nil
+}
+
+// Transport wraps the base transport so that requests to
+// urls matching an auth entry carry its credentials.
+func (as Auths) Transport(base http.RoundTripper) http.RoundTripper {
+	if len(as) == 0 {
+		return base
+	}
+	return authTransport{base: base, auths: as}
+}
+
+type authTransport struct {
+	base  http.RoundTripper
+	auths Auths
+}
+
+func (t authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	a := t.auths.match(req.URL.String())
+	if a == nil {
+		return t.base.RoundTrip(req)
+	}
+	r := cloneRequest(req)
+	if a.scheme == "basic" {
+		r.SetBasicAuth(a.user, a.pass)
+		return t.base.RoundTrip(r)
+	}
+	if h := a.digest(r); h != "" {
+		r.Header.Set("Authorization", h)
+	}
+	res, err := t.base.RoundTrip(r)
+	if err != nil || res.StatusCode != 401 || (req.Body != nil && req.GetBody == nil) {
+		return res, err
+	}
+	chal := digestChallenge(res.Header.Get("WWW-Authenticate"))
+	if chal == nil {
+		return res, err
+	}
+	res.Body.Close()
+	a.mu.Lock()
+	a.chal, a.nc = chal, 0
+	a.mu.Unlock()
+	r = cloneRequest(req)
+	if req.GetBody != nil {
+		if r.Body, err = req.GetBody(); err != nil {
+			return nil, err
+		}
+	}
+	r.Header.Set("Authorization", a.digest(r))
+	return t.base.RoundTrip(r)
+}
+
+// cloneRequest returns a copy of the request with its own
+// headers; as a RoundTripper must not modify its request.
+func cloneRequest(req *http.Request) *http.Request {
+	r := new(http.Request)
+	*r = *req
+	r.Header = cloneHeader(req.Header)
+	return r
+}
+
+// cloneHeader returns a deep copy of a header.
+func cloneHeader(h http.Header) http.Header {
+	c := make(http.Header, len(h))
+	for name, vals := range h {
+		c[name] = append([]string(nil), vals...)
+	}
+	return c
+}
+
+// digestChallenge parses the parameters of a Digest
+// WWW-Authenticate header; or nil for other schemes.
+func digestChallenge(h string) map[string]string {
+	if len(h) < 7 || !strings.EqualFold(h[:7], "digest ") {
+		return nil
+	}
+	chal := map[string]string{}
+	s := h[7:]
+	for s != "" {
+		s = strings.TrimLeft(s, " ,")
+		eq := strings.Index(s, "=")
+		if eq < 0 {
+			break
+		}
+		k := strings.ToLower(strings.TrimSpace(s[:eq]))
+		s = s[eq+1:]
+		var v string
+		if strings.HasPrefix(s, `"`) {
+			end := strings.Index(s[1:], `"`)
+			if end < 0 {
+				end = len(s) - 1
+			}
+			v, s = s[1:end+1], s[end+1:]
+			s = strings.TrimPrefix(s, `"`)
+		} else if end := strings.Index(s, ","); end >= 0 {
+			v, s = strings.TrimSpace(s[:end]), s[end:]
+		} else {
+			v, s = strings.TrimSpace(s), ""
+		}
+		chal[k] = v
+	}
+	return chal
+}
+
+// digest returns the Authorization header answering the last
+// challenge for the request; or "" if none were received yet.
+// Only the MD5, MD5-sess and SHA-256 algorithms with the auth
+// quality of protection are supported.
+func (a *Auth) digest(r *http.Request) string {
+	a.mu.Lock()
+	chal := a.chal
+	a.nc++
+	nc := fmt.Sprintf("%08x", a.nc)
+	a.mu.Unlock()
+	if chal == nil {
+		return ""
+	}
+	var h func() hash.Hash = md5.New
+	algorithm := chal["algorithm"]
+	if strings.HasPrefix(strings.ToUpper(algorithm), "SHA-256") {
+		h = sha256.New
+	}
+	H := func(s string) string {
+		d := h()
+		d.Write([]byte(s))
+		return hex.EncodeToString(d.Sum(nil))
+	}
+	b := make([]byte, 8)
+	rand.Read(b)
+	cnonce := hex.EncodeToString(b)
+	uri := r.URL.RequestURI()
+	ha1 := H(a.user + ":" + chal["realm"] + ":" + a.pass)
+	if strings.HasSuffix(strings.ToLower(algorithm), "-sess") {
+		ha1 = H(ha1 + ":" + chal["nonce"] + ":" + cnonce)
+	}
+	ha2 := H(r.Method + ":" + uri)
+	auth := fmt.Sprintf(`Digest username="%s", realm="%s", nonce="%s", uri="%s"`, a.user, chal["realm"], chal["nonce"], uri)
+	qop := false
+	for _, q := range strings.Split(chal["qop"], ",") {
+		qop = qop || strings.TrimSpace(q) == "auth"
+	}
+	if qop {
+		auth += fmt.Sprintf(`, qop=auth, nc=%s, cnonce="%s", response="%s"`, nc, cnonce, H(ha1+":"+chal["nonce"]+":"+nc+":"+cnonce+":auth:"+ha2))
+	} else {
+		auth += fmt.Sprintf(`, response="%s"`, H(ha1+":"+chal["nonce"]+":"+ha2))
+	}
+	if algorithm != "" {
+		auth += ", algorithm=" + algorithm
+	}
+	if opaque, ok := chal["opaque"]; ok {
+		auth += fmt.Sprintf(`, opaque="%s"`, opaque)
+	}
+	return auth
+}
+
+type Login struct {
+	url    string
+	fields url.Values
+}
+
+// Logins are the forms posted, before crawling, to start the
+// sessions whose cookies are sent with the following requests.
+// They are declared in the [login] section of the config file
+// as tab delimited url, user field, password field and
+// credential entries; optionally followed by extra name=value
+// form fields:
+//   http://localhost:8080/.magnolia/admincentral	mgnlUserId	mgnlUserPSWD	env:magusr
+type Logins []Login
+
+func (ls *Logins) Parse(fields []string) error {
+	if len(fields) < 4 || fields[0] == "" || fields[1] == "" || fields[2] == "" {
+		return ErrConfigFile{line: strings.Join(fields, "\t")}
+	}
+	user, pass, err := Credential(fields[3])
+	if err != nil {
+		return err
+	}
+	form := url.Values{}
+	form.Set(fields[1], user)
+	form.Set(fields[2], pass)
+	for _, f := range fields[4:] {
+		nv := strings.SplitN(f, "=", 2)
+		if len(nv) != 2 {
+			return ErrConfigFile{line: strings.Join(fields, "\t")}
+		}
+		form.Add(nv[0], nv[1])
+	}
+	*ls = append(*ls, Login{url: fields[0], fields: form})
+	return nil
+}
+
+// Login posts each login form, capturing the session cookies
+// set by its response in the cookie jar. Redirects are not
+// followed; a successful login usually redirects elsewhere.
+// Logins are not recorded to archives, as they hold the
+// credentials; nor are they made while replaying an archive.
+func (ls Logins) Login(l log.Logger, envs Envs) error {
+	envs.recorder = nil
+	for _, login := range ls {
+		if envs.replay != nil {
+			l.Info("login", "url", login.url, "err", "", "code", 0, "replay", true)
+			continue
+		}
+		client := envs.NewClient()
+		client.CheckRedirect = func(_ *http.Request, _ []*http.Request) error {
+			return http.ErrUseLastResponse
+		}
+		res, err := client.PostForm(login.url, login.fields)
+		if err != nil {
+			l.Error("login", "url", login.url, "err", err.Error(), "code", 0)
+			return err
+		}
+		ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		u, _ := url.Parse(login.url)
+		cookies := 0
+		if envs.jar != nil {
+			cookies = len(envs.jar.Cookies(u))
+		}
+		if res.StatusCode >= 400 {
+			l.Error("login", "url", login.url, "err", "", "code", res.StatusCode, "cookies", cookies)
+			return ErrLogin{url: login.url, code: res.StatusCode}
+		}
+		l.Info("login", "url", login.url, "err", "", "code", res.StatusCode, "cookies", cookies)
+	}
+	return nil
+}
+
+type jarCookie struct {
+	url    string
+	cookie *http.Cookie
+}
+
+// Jar is a cookie jar persisted to a file between crawls.
+// Each line of the file holds the url a cookie was set by
+// and its tab delimited Set-Cookie header value.
+type Jar struct {
+	*cookiejar.Jar
+	file    string
+	mu      sync.Mutex
+	cookies map[string]jarCookie
+}
+
+// NewJar returns a cookie jar loaded with the cookies of
+// file, if it exists, and saved back to it by Save.
+func NewJar(file string) (*Jar, error) {
+	cj, err := cookiejar.New(nil)
+	if err != nil {
+		return nil, err
+	}
+	j := &Jar{Jar: cj, file: file, cookies: make(map[string]jarCookie)}
+	if file == "" {
+		return j, nil
+	}
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return j, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	in := bufio.NewScanner(f)
+	for in.Scan() {
+		us := strings.SplitN(in.Text(), "\t", 2)
+		if len(us) != 2 {
+			continue
+		}
+		u, err := url.Parse(us[0])
+		if err != nil {
+			continue
+		}
+		res := http.Response{Header: http.Header{"Set-Cookie": {us[1]}}}
+		j.SetCookies(u, res.Cookies())
+	}
+	return j, in.Err()
+}
+
+// SetCookies stores the cookies in the jar and records
+// them to be saved; Max-Age is converted to an Expires
+// time so that it still holds once the jar is reloaded.
+func (j *Jar) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	j.Jar.SetCookies(u, cookies)
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for _, c := range cookies {
+		domain := c.Domain
+		if domain == "" {
+			domain = u.Hostname()
+		}
+		key := domain + ";" + c.Path + ";" + c.Name
+		if c.MaxAge < 0 || (!c.Expires.IsZero() && c.Expires.Before(time.Now())) {
+			delete(j.cookies, key)
+			continue
+		}
+		cc := *c
+		if cc.MaxAge > 0 {
+			cc.Expires = time.Now().Add(time.Duration(cc.MaxAge) * time.Second)
+			cc.MaxAge = 0
+		}
+		j.cookies[key] = jarCookie{url: u.String(), cookie: &cc}
+	}
+}
+
+// Save writes the unexpired cookies to the jar's file.
+func (j *Jar) Save() error {
+	if j == nil || j.file == "" {
+		return nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	var lines []string
+	for _, jc := range j.cookies {
+		if jc.cookie.Expires.IsZero() || jc.cookie.Expires.After(time.Now()) {
+			lines = append(lines, jc.url+"\t"+jc.cookie.String()+"\n")
+		}
+	}
+	return ioutil.WriteFile(j.file, []byte(strings.Join(lines, "")), 0600)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// digestServer challenges requests without a valid digest
+// Authorization header, verifying responses as RFC 7616
+// servers do.
+type digestServer struct {
+	algorithm string
+	qop       string
+	mu        sync.Mutex
+	requests  int
+	challenge int
+}
+
+func (ds *digestServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ds.mu.Lock()
+	ds.requests++
+	ds.mu.Unlock()
+	if ds.valid(r) {
+		fmt.Fprint(w, "ok")
+		return
+	}
+	ds.mu.Lock()
+	ds.challenge++
+	ds.mu.Unlock()
+	chal := `Digest realm="staging", nonce="dcd98b7102dd2f0e8b11d0f600bfb0c093", opaque="5ccc069c403ebaf9f0171e9517f40e41"`
+	if ds.qop != "" {
+		chal += `, qop="` + ds.qop + `"`
+	}
+	if ds.algorithm != "" {
+		chal += ", algorithm=" + ds.algorithm
+	}
+	w.Header().Set("WWW-Authenticate", chal)
+	w.WriteHeader(401)
+}
+
+func (ds *digestServer) valid(r *http.Request) bool {
+	auth := digestChallenge(r.Header.Get("Authorization"))
+	if auth == nil || auth["username"] != "thrawler" || auth["uri"] != r.URL.RequestURI() || auth["opaque"] != "5ccc069c403ebaf9f0171e9517f40e41" {
+		return false
+	}
+	var h func() hash.Hash = md5.New
+	if strings.HasPrefix(ds.algorithm, "SHA-256") {
+		h = sha256.New
+	}
+	H := func(s string) string {
+		d := h()
+		d.Write([]byte(s))
+		return hex.EncodeToString(d.Sum(nil))
+	}
+	ha1 := H("thrawler:staging:s3cret")
+	if strings.HasSuffix(ds.algorithm, "-sess") {
+		ha1 = H(ha1 + ":" + auth["nonce"] + ":" + auth["cnonce"])
+	}
+	ha2 := H(r.Method + ":" + r.URL.RequestURI())
+	if ds.qop == "" {
+		return auth["response"] == H(ha1+":"+auth["nonce"]+":"+ha2)
+	}
+	return auth["qop"] == "auth" && auth["response"] == H(ha1+":"+auth["nonce"]+":"+auth["nc"]+":"+auth["cnonce"]+":auth:"+ha2)
+}
+
+func TestDigestAuth(t *testing.T) {
+	for _, ds := range []*digestServer{
+		{qop: "auth"},
+		{qop: "auth,auth-int", algorithm: "MD5"},
+		{qop: "auth", algorithm: "MD5-sess"},
+		{qop: "auth", algorithm: "SHA-256"},
+		{algorithm: "MD5"},
+	} {
+		ts := httptest.NewServer(ds)
+		auths := Auths{{re: regexp.MustCompile("^" + regexp.QuoteMeta(ts.URL)), scheme: "digest", user: "thrawler", pass: "s3cret"}}
+		client := &http.Client{Transport: auths.Transport(http.DefaultTransport)}
+		for _, path := range []string{"/", "/news/?page=2", "/about"} {
+			res, err := client.Get(ts.URL + path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+			if res.StatusCode != 200 {
+				t.Errorf("%s %s: status %d", ds.algorithm, path, res.StatusCode)
+			}
+		}
+		// Only the first request is challenged; following
+		// requests answer the cached challenge.
+		if ds.challenge != 1 || ds.requests != 4 {
+			t.Errorf("qop %q algorithm %q: %d challenges of %d requests, want 1 of 4", ds.qop, ds.algorithm, ds.challenge, ds.requests)
+		}
+		ts.Close()
+	}
+}
+
+func TestBasicAuth(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, ok := r.BasicAuth(); !ok || user != "thrawler" || pass != "s3cret" {
+			w.WriteHeader(401)
+		}
+	}))
+	defer ts.Close()
+	auths := Auths{{re: regexp.MustCompile(`/private/`), scheme: "basic", user: "thrawler", pass: "s3cret"}}
+	client := &http.Client{Transport: auths.Transport(http.DefaultTransport)}
+	for path, code := range map[string]int{"/private/": 200, "/public/": 401} {
+		res, err := client.Get(ts.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != code {
+			t.Errorf("%s: status %d, want %d", path, res.StatusCode, code)
+		}
+	}
+	// Credentials are added to a copy of the request.
+	req, err := http.NewRequest("GET", ts.URL+"/private/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept", "text/html")
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != 200 || len(req.Header) != 1 {
+		t.Errorf("status %d, request headers %v; want 200 and only Accept", res.StatusCode, req.Header)
+	}
+}
@@ -0,0 +1,130 @@
+// Response body decoding and size limits (body)
+package main
+
+import (
+	"compress/gzip"
+	"github.com/andybalholm/brotli"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+type ErrContentEncoding struct {
+	encoding string
+}
+
+func (e ErrContentEncoding) Error() string {
+	return "Unsupported Content-Encoding: '" + e.encoding + "'"
+}
+
+type ErrBodyLimit struct {
+	entry string
+}
+
+func (e ErrBodyLimit) Error() string {
+	return "Body size limit must be of the form type=size: '" + e.entry + "'"
+}
+
+// Bodies reads response bodies the way browsers receive them.
+// Compressed transfer is optional, as Magnolia CMS gzip
+// responses have a 2GB limit; when enabled gzip and brotli
+// encoded bodies are requested and decoded. Decoded bodies
+// are truncated at the size limit of their content type; so
+// a giant PDF or runaway page cannot exhaust memory.
+type Bodies struct {
+	compress bool
+	limits   map[string]int64
+}
+
+// NewBodies returns Bodies limited by the comma delimited
+// content type and size pairs; where a type may be a media
+// type, a major type such as image/* or * for all others.
+// Sizes may use a K, M or G suffix, and 0 means no limit.
+// EX: "text/html=20M,text/css=5M,*=10M"
+func NewBodies(compress bool, limits string) (Bodies, error) {
+	b := Bodies{compress: compress, limits: make(map[string]int64)}
+	for _, l := range strings.Split(limits, ",") {
+		if l = strings.TrimSpace(l); l == "" {
+			continue
+		}
+		ts := strings.SplitN(l, "=", 2)
+		if len(ts) != 2 || strings.TrimSpace(ts[0]) == "" {
+			return b, ErrBodyLimit{entry: l}
+		}
+		size, err := parseBytes(ts[1])
+		if err != nil {
+			return b, err
+		}
+		b.limits[strings.ToLower(strings.TrimSpace(ts[0]))] = size
+	}
+	return b, nil
+}
+
+// Accept asks for a compressed response if enabled.
+func (b Bodies) Accept(req *http.Request) {
+	if b.compress {
+		req.Header.Set("Accept-Encoding", "gzip, br")
+	}
+}
+
+// Limit returns the size limit of a Content-Type header
+// value; or 0 if its bodies are not limited.
+func (b Bodies) Limit(content string) int64 {
+	media, _, err := mime.ParseMediaType(content)
+	if err != nil {
+		media = "*"
+	}
+	if size, ok := b.limits[media]; ok {
+		return size
+	}
+	if i := strings.Index(media, "/"); i >= 0 {
+		if size, ok := b.limits[media[:i]+"/*"]; ok {
+			return size
+		}
+	}
+	return b.limits["*"]
+}
+
+type countReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// Read returns the decoded body of a response along with the
+// number of bytes transferred; and true if the body was
+// truncated at its content type's size limit.
+func (b Bodies) Read(res *http.Response) ([]byte, int64, bool, error) {
+	wire := &countReader{r: res.Body}
+	var r io.Reader = wire
+	switch enc := strings.ToLower(strings.TrimSpace(res.Header.Get("Content-Encoding"))); enc {
+	case "", "identity":
+	case "gzip", "x-gzip":
+		gz, err := gzip.NewReader(wire)
+		if err != nil {
+			return nil, wire.n, false, err
+		}
+		defer gz.Close()
+		r = gz
+	case "br":
+		r = brotli.NewReader(wire)
+	default:
+		return nil, 0, false, ErrContentEncoding{encoding: enc}
+	}
+	limit := b.Limit(res.Header.Get("Content-Type"))
+	if limit > 0 {
+		r = io.LimitReader(r, limit+1)
+	}
+	body, err := ioutil.ReadAll(r)
+	if limit > 0 && int64(len(body)) > limit {
+		return body[:limit], wire.n, true, err
+	}
+	return body, wire.n, false, err
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	log "gopkg.in/inconshreveable/log15.v2"
+)
+
+func TestBodiesRead(t *testing.T) {
+	page := strings.Repeat("<p>thrawler</p>", 1000)
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	w.Write([]byte(page))
+	w.Close()
+	res := func(encoding string, body []byte) *http.Response {
+		res := &http.Response{Header: make(http.Header), Body: ioutil.NopCloser(bytes.NewReader(body))}
+		res.Header.Set("Content-Type", "text/html;charset=UTF-8")
+		if encoding != "" {
+			res.Header.Set("Content-Encoding", encoding)
+		}
+		return res
+	}
+	// Bodies of types without a limit are read whole.
+	unlimited, err := NewBodies(false, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, wire, truncated, err := unlimited.Read(res("", []byte(page)))
+	if err != nil || string(body) != page || wire != int64(len(page)) || truncated {
+		t.Errorf("unlimited read %d bytes of %d wire bytes, truncated %v, err %v", len(body), wire, truncated, err)
+	}
+	body, wire, truncated, err = unlimited.Read(res("gzip", gz.Bytes()))
+	if err != nil || string(body) != page || wire != int64(gz.Len()) || truncated {
+		t.Errorf("gzip read %d bytes of %d wire bytes, truncated %v, err %v", len(body), wire, truncated, err)
+	}
+	limited, err := NewBodies(true, "text/html=1K,*=0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _, truncated, err = limited.Read(res("gzip", gz.Bytes()))
+	if err != nil || string(body) != page[:1024] || !truncated {
+		t.Errorf("limited read %d bytes, truncated %v, err %v", len(body), truncated, err)
+	}
+	if _, _, _, err := limited.Read(res("compress", gz.Bytes())); err == nil {
+		t.Error("read an unsupported Content-Encoding")
+	}
+	if _, err := NewBodies(false, "text/html"); err == nil {
+		t.Error("parsed a limit without a size")
+	}
+}
+
+func TestBodiesLimit(t *testing.T) {
+	b, err := NewBodies(false, "text/html=20M, text/css=5M, image/*=1M, *=10M")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for content, want := range map[string]int64{
+		"text/html;charset=UTF-8": 20 << 20,
+		"TEXT/CSS":                5 << 20,
+		"image/png":               1 << 20,
+		"application/pdf":         10 << 20,
+		"":                        10 << 20,
+	} {
+		if got := b.Limit(content); got != want {
+			t.Errorf("Limit(%q) = %d, want %d", content, got, want)
+		}
+	}
+	if _, err := NewBodies(false, "text/html=-5M"); err == nil {
+		t.Error("parsed a negative limit")
+	}
+}
+
+// Compressed pages are decoded before filtering, and bodies
+// over their type's limit are truncated, including those of
+// stylesheets served with an unexpected Content-Type.
+func TestRequestBodies(t *testing.T) {
+	page := `<html><head><link rel="stylesheet" type="text/css" href="/style.css"></head><body><a href="/big">big</a><img src="/logo.png"></body></html>`
+	css := `body { background: url(/bg.png); }` + strings.Repeat(" ", 2048) + `p { background: url(/cut.png); }`
+	var accept string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			accept = r.Header.Get("Accept-Encoding")
+			w.Header().Set("Content-Type", "text/html")
+			w.Header().Set("Content-Encoding", "br")
+			bw := brotli.NewWriter(w)
+			bw.Write([]byte(page))
+			bw.Close()
+		case "/big":
+			w.Header().Set("Content-Type", "text/html")
+			w.Header().Set("Content-Encoding", "gzip")
+			gw := gzip.NewWriter(w)
+			fmt.Fprint(gw, "<html><body>"+strings.Repeat("<p>thrawler</p>", 1000)+`<a href="/cut">cut</a></body></html>`)
+			gw.Close()
+		case "/style.css":
+			w.Header().Set("Content-Type", "text/plain")
+			fmt.Fprint(w, css)
+		case "/logo.png", "/bg.png":
+			w.Header().Set("Content-Type", "image/png")
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+	envs := testEnvs(t, regexp.QuoteMeta(ts.URL))
+	var err error
+	if envs.bodies, err = NewBodies(true, "text/html=1K,*=1K"); err != nil {
+		t.Fatal(err)
+	}
+	tl := testCrawl(envs, 2, ts.URL+"/")
+	if accept != "gzip, br" {
+		t.Errorf("Accept-Encoding %q, want gzip, br", accept)
+	}
+	reqs := make(map[string]log.Ctx)
+	for _, ctx := range tl.find("req") {
+		reqs[ctx["url"].(string)] = ctx
+	}
+	for _, url := range []string{"/logo.png", "/big", "/style.css", "/bg.png"} {
+		if _, ok := reqs[ts.URL+url]; !ok {
+			t.Errorf("%s not requested", url)
+		}
+	}
+	for _, url := range []string{"/cut", "/cut.png"} {
+		if _, ok := reqs[ts.URL+url]; ok {
+			t.Errorf("%s linked past the body limit was requested", url)
+		}
+	}
+	if ctx := reqs[ts.URL+"/"]; ctx["encoding"] != "br" || ctx["wire_bytes"].(int64) >= int64(len(page)) {
+		t.Errorf("page encoding %v of %v wire bytes, want br under %d", ctx["encoding"], ctx["wire_bytes"], len(page))
+	}
+	if err := reqs[ts.URL+"/style.css"]["err"]; err == "" {
+		t.Errorf("stylesheet served as text/plain not reported")
+	}
+	truncated := make(map[string]interface{})
+	for _, ctx := range tl.find("truncated") {
+		truncated[ctx["url"].(string)] = ctx["limit"]
+	}
+	if len(truncated) != 2 || truncated[ts.URL+"/big"] != 1024 || truncated[ts.URL+"/style.css"] != 1024 {
+		t.Errorf("truncated %v, want /big and /style.css at 1024 bytes", truncated)
+	}
+}
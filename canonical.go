@@ -0,0 +1,92 @@
+// rel=canonical declaration checks (canonical)
+package main
+
+import (
+	"golang.org/x/net/html"
+	log "gopkg.in/inconshreveable/log15.v2"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Canonicals records the canonical urls declared by pages
+// so that canonicals pointing at non-200 urls may be reported
+// once the crawl completes. It is shared by all threads.
+type Canonicals struct {
+	mu   *sync.Mutex
+	urls map[string]string
+}
+
+func NewCanonicals() Canonicals {
+	return Canonicals{mu: &sync.Mutex{}, urls: make(map[string]string)}
+}
+
+// Canonical compares the page's declared <link rel="canonical">
+// url, after running it through the same canonicalization as
+// all other links, with the page's own canonical url. Missing
+// and mismatched declarations, and declarations on a host that
+// is not crawled, are logged as canonical entries.
+func (ls *Links) Canonical(root *html.Node) {
+	var declared string
+	var found bool
+	walkHtml(root, nil, false, func(n *html.Node, _ []string) {
+		if !found && n.Data == "link" && linkRel(getAttr(n, "rel")) == "canonical" {
+			declared = getAttr(n, "href")
+			found = true
+		}
+	})
+	if !found {
+		ls.log.Warn("canonical", "src", ls.source, "url", ls.String(), "check", "missing", "declared", "", "err", "")
+		return
+	}
+	li, err := ls.canon(ls.LinkInfo, declared)
+	if _, offsite := err.(ErrNotBaseDomain); offsite {
+		ls.log.Warn("canonical", "src", ls.source, "url", ls.String(), "check", "offsite", "declared", declared, "err", err.Error())
+		return
+	} else if err != nil {
+		ls.log.Warn("canonical", "src", ls.source, "url", ls.String(), "check", "mismatch", "declared", declared, "err", err.Error())
+		return
+	}
+	if li.String() != ls.String() {
+		ls.log.Warn("canonical", "src", ls.source, "url", ls.String(), "check", "mismatch", "declared", li.String(), "err", "")
+	}
+	ls.canonicals.mu.Lock()
+	if _, ok := ls.canonicals.urls[li.String()]; !ok {
+		ls.canonicals.urls[li.String()] = ls.String()
+	}
+	ls.canonicals.mu.Unlock()
+}
+
+// Report logs a canonical entry for each declared canonical
+// url that did not return a 200 status. Declared canonicals
+// are queued as existence checked links by FilterHtml; so
+// their status is known once the crawl completes. Those that
+// were never requested are logged as unverified.
+func (c Canonicals) Report(l log.Logger, envs Envs) {
+	if c.urls == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var urls []string
+	for url := range c.urls {
+		urls = append(urls, url)
+	}
+	sort.Strings(urls)
+	for _, url := range urls {
+		if stat, ok := envs.Status(url); !ok || stat == -1 {
+			l.Warn("canonical", "src", "", "url", c.urls[url], "check", "unverified", "declared", url, "err", "")
+		} else if stat != 200 {
+			l.Warn("canonical", "src", "", "url", c.urls[url], "check", "status", "declared", url, "err", ErrNon200Status{status: stat}.Error())
+		}
+	}
+}
+
+// Status returns the status code recorded for a url.
+// It must only be used once crawling has completed.
+func (e Envs) Status(url string) (int, bool) {
+	if e.visited == nil || strings.TrimSpace(url) == "" {
+		return 0, false
+	}
+	return e.visited.Status(url)
+}
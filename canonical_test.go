@@ -0,0 +1,65 @@
+package main
+
+import (
+	"testing"
+)
+
+// canonicalChecks returns the check of each canonical entry
+// logged, by the declared url.
+func canonicalChecks(tl *testLog) map[string]string {
+	checks := make(map[string]string)
+	for _, ctx := range tl.find("canonical") {
+		checks[ctx["declared"].(string)] = ctx["check"].(string)
+	}
+	return checks
+}
+
+func TestCanonicalOffsite(t *testing.T) {
+	tests := []struct {
+		page     string
+		declared string
+		check    string
+	}{
+		{`<link rel="canonical" href="https://www.txstate.edu/a">`, "https://www.txstate.edu/a", ""},
+		{`<link rel="canonical" href="/b">`, "https://www.txstate.edu/b", "mismatch"},
+		{`<link rel="canonical" href="https://www.example.com/a">`, "https://www.example.com/a", "offsite"},
+	}
+	for _, test := range tests {
+		ls := testLinks(t, "https://www.txstate.edu/a")
+		envs := testEnvs(t, `^https://www\.txstate\.edu/`)
+		ls.canon, ls.canonicals = envs.canon, NewCanonicals()
+		tl := &testLog{}
+		ls.log = tl.logger()
+		if _, err := ls.FilterHtml([]byte("<html><head>" + test.page + "</head></html>")); err != nil {
+			t.Fatal(err)
+		}
+		if check := canonicalChecks(tl)[test.declared]; check != test.check {
+			t.Errorf("%s: check %q, want %q", test.page, check, test.check)
+		}
+	}
+}
+
+func TestCanonicalReport(t *testing.T) {
+	envs := testEnvs(t, ".")
+	c := NewCanonicals()
+	c.urls["https://www.txstate.edu/ok"] = "https://www.txstate.edu/ok.html"
+	c.urls["https://www.txstate.edu/gone"] = "https://www.txstate.edu/gone.html"
+	c.urls["https://www.txstate.edu/never"] = "https://www.txstate.edu/never.html"
+	envs.visited.Set("https://www.txstate.edu/ok", 200)
+	envs.visited.Set("https://www.txstate.edu/gone", 404)
+	tl := &testLog{}
+	c.Report(tl.logger(), envs)
+	checks := canonicalChecks(tl)
+	want := map[string]string{
+		"https://www.txstate.edu/gone":  "status",
+		"https://www.txstate.edu/never": "unverified",
+	}
+	if len(checks) != len(want) {
+		t.Errorf("checks %v, want %v", checks, want)
+	}
+	for url, check := range want {
+		if checks[url] != check {
+			t.Errorf("%s: check %q, want %q", url, checks[url], check)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+// TLS options and certificate reporting (certs)
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	log "gopkg.in/inconshreveable/log15.v2"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type ErrCaBundle struct {
+	file string
+}
+
+func (e ErrCaBundle) Error() string {
+	return "No PEM certificates found in CA bundle '" + e.file + "'"
+}
+
+// NewTLSConfig returns the TLS configuration used for https
+// requests. Certificates of a custom CA bundle are trusted in
+// addition to the system's; and a client certificate and key
+// may be presented to hosts requiring one. Insecure skips all
+// server certificate verification.
+func NewTLSConfig(cacert string, cert string, key string, insecure bool) (*tls.Config, error) {
+	conf := &tls.Config{InsecureSkipVerify: insecure}
+	if cacert != "" {
+		pem, err := ioutil.ReadFile(cacert)
+		if err != nil {
+			return nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, ErrCaBundle{file: cacert}
+		}
+		conf.RootCAs = pool
+	}
+	if cert != "" || key != "" {
+		if key == "" {
+			key = cert
+		}
+		pair, err := tls.LoadX509KeyPair(cert, key)
+		if err != nil {
+			return nil, err
+		}
+		conf.Certificates = []tls.Certificate{pair}
+	}
+	return conf, nil
+}
+
+// tlsVersions and tlsCiphers name the protocol versions and
+// cipher suites a host may negotiate. TLS 1.3 values are
+// numeric, as the Go 1.8 crypto/tls has no constants for them.
+var tlsVersions = map[uint16]string{
+	tls.VersionTLS10: "TLS1.0",
+	tls.VersionTLS11: "TLS1.1",
+	tls.VersionTLS12: "TLS1.2",
+	0x0304:           "TLS1.3",
+}
+
+var tlsCiphers = map[uint16]string{
+	tls.TLS_RSA_WITH_RC4_128_SHA:                "TLS_RSA_WITH_RC4_128_SHA",
+	tls.TLS_RSA_WITH_3DES_EDE_CBC_SHA:           "TLS_RSA_WITH_3DES_EDE_CBC_SHA",
+	tls.TLS_RSA_WITH_AES_128_CBC_SHA:            "TLS_RSA_WITH_AES_128_CBC_SHA",
+	tls.TLS_RSA_WITH_AES_256_CBC_SHA:            "TLS_RSA_WITH_AES_256_CBC_SHA",
+	tls.TLS_RSA_WITH_AES_128_CBC_SHA256:         "TLS_RSA_WITH_AES_128_CBC_SHA256",
+	tls.TLS_RSA_WITH_AES_128_GCM_SHA256:         "TLS_RSA_WITH_AES_128_GCM_SHA256",
+	tls.TLS_RSA_WITH_AES_256_GCM_SHA384:         "TLS_RSA_WITH_AES_256_GCM_SHA384",
+	tls.TLS_ECDHE_ECDSA_WITH_RC4_128_SHA:        "TLS_ECDHE_ECDSA_WITH_RC4_128_SHA",
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA:    "TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA",
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA:    "TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA",
+	tls.TLS_ECDHE_RSA_WITH_RC4_128_SHA:          "TLS_ECDHE_RSA_WITH_RC4_128_SHA",
+	tls.TLS_ECDHE_RSA_WITH_3DES_EDE_CBC_SHA:     "TLS_ECDHE_RSA_WITH_3DES_EDE_CBC_SHA",
+	tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA:      "TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA",
+	tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA:      "TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA",
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256: "TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256",
+	tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256:   "TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256",
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256:   "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256",
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256: "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256",
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384:   "TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384",
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384: "TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384",
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305:    "TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256",
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305:  "TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256",
+	0x1301: "TLS_AES_128_GCM_SHA256",
+	0x1302: "TLS_AES_256_GCM_SHA384",
+	0x1303: "TLS_CHACHA20_POLY1305_SHA256",
+}
+
+// cipherName returns the name of a cipher suite,
+// or its hex value if unknown.
+func cipherName(id uint16) string {
+	if name, ok := tlsCiphers[id]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%04X", id)
+}
+
+type certInfo struct {
+	version string
+	cipher  string
+	subject string
+	issuer  string
+	sans    []string
+	expires time.Time
+}
+
+// Certs records the negotiated TLS connection details and
+// server certificate of each https host, so that they may
+// be reported once the crawl completes. It is shared by
+// all threads.
+type Certs struct {
+	mu     sync.Mutex
+	hosts  map[string]certInfo
+	expiry int
+}
+
+// NewCerts returns Certs that warn of certificates
+// expiring within the given number of days.
+func NewCerts(expiry int) *Certs {
+	return &Certs{hosts: make(map[string]certInfo), expiry: expiry}
+}
+
+// Add records the connection state of the first
+// response received from a host.
+func (c *Certs) Add(host string, state *tls.ConnectionState) {
+	if state == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.hosts[host]; ok {
+		return
+	}
+	info := certInfo{version: tlsVersions[state.Version], cipher: cipherName(state.CipherSuite)}
+	if len(state.PeerCertificates) > 0 {
+		cert := state.PeerCertificates[0]
+		info.subject = cert.Subject.CommonName
+		info.issuer = cert.Issuer.CommonName
+		info.sans = append(info.sans, cert.DNSNames...)
+		for _, ip := range cert.IPAddresses {
+			info.sans = append(info.sans, ip.String())
+		}
+		info.expires = cert.NotAfter
+	}
+	c.hosts[host] = info
+}
+
+// Report logs a tls entry for each https host, and a
+// cert-expiry warning for each certificate expiring
+// within the expiry threshold.
+func (c *Certs) Report(l log.Logger) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var hosts []string
+	for host := range c.hosts {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	for _, host := range hosts {
+		info := c.hosts[host]
+		days := int(time.Until(info.expires).Hours() / 24)
+		l.Info("tls", "host", host, "version", info.version, "cipher", info.cipher, "subject", info.subject, "issuer", info.issuer, "sans", strings.Join(info.sans, " "), "expires", info.expires, "days", days)
+		if days < c.expiry {
+			l.Warn("cert-expiry", "host", host, "subject", info.subject, "expires", info.expires, "days", days, "threshold", c.expiry)
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+)
+
+// testCert returns a self signed certificate
+// for a subject, expiring at the given time.
+func testCert(t *testing.T, subject string, expires time.Time) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: subject},
+		DNSNames:     []string{subject},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     expires,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+// writePem writes a pem block of the given type to a file of dir.
+func writePem(t *testing.T, dir string, name string, typ string, der []byte) string {
+	file := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+// get requests the server's root with the TLS configuration.
+func get(conf *tls.Config, url string) error {
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: conf}}
+	res, err := client.Get(url)
+	if err == nil {
+		res.Body.Close()
+	}
+	return err
+}
+
+func TestNewTLSConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+	cacert := writePem(t, dir, "ca.pem", "CERTIFICATE", ts.TLS.Certificates[0].Certificate[0])
+	empty := filepath.Join(dir, "empty.pem")
+	if err := ioutil.WriteFile(empty, []byte("no certificates"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	conf, err := NewTLSConfig("", "", "", false)
+	if err != nil || conf.InsecureSkipVerify || conf.RootCAs != nil || len(conf.Certificates) != 0 {
+		t.Errorf("default config %+v, %v", conf, err)
+	}
+	if err := get(conf, ts.URL); err == nil {
+		t.Errorf("untrusted server certificate verified")
+	}
+	if conf, err = NewTLSConfig("", "", "", true); err != nil || get(conf, ts.URL) != nil {
+		t.Errorf("insecure config did not skip verification: %v", err)
+	}
+	if conf, err = NewTLSConfig(cacert, "", "", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := get(conf, ts.URL); err != nil {
+		t.Errorf("server certificate not trusted with CA bundle: %v", err)
+	}
+	if _, err := NewTLSConfig(empty, "", "", false); err != (ErrCaBundle{file: empty}) {
+		t.Errorf("CA bundle without certificates: %v, want ErrCaBundle", err)
+	}
+	if _, err := NewTLSConfig(filepath.Join(dir, "missing.pem"), "", "", false); err == nil {
+		t.Errorf("missing CA bundle accepted")
+	}
+}
+
+// A client certificate, with its key in the same
+// or a separate file, is presented to the server.
+func TestNewTLSConfigClientCert(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cert, key := testCert(t, "thrawler", time.Now().Add(time.Hour))
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile := writePem(t, dir, "client.pem", "CERTIFICATE", cert.Raw)
+	keyFile := writePem(t, dir, "client.key", "EC PRIVATE KEY", keyDer)
+	both, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPem, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bothFile := filepath.Join(dir, "both.pem")
+	if err := ioutil.WriteFile(bothFile, append(both, keyPem...), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var presented string
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.PeerCertificates) > 0 {
+			presented = r.TLS.PeerCertificates[0].Subject.CommonName
+		}
+	}))
+	ts.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	ts.StartTLS()
+	defer ts.Close()
+
+	for _, files := range [][2]string{{certFile, keyFile}, {bothFile, ""}} {
+		presented = ""
+		conf, err := NewTLSConfig("", files[0], files[1], true)
+		if err != nil {
+			t.Fatalf("%v: %v", files, err)
+		}
+		if err := get(conf, ts.URL); err != nil || presented != "thrawler" {
+			t.Errorf("%v: presented %q, %v", files, presented, err)
+		}
+	}
+	if _, err := NewTLSConfig("", keyFile, certFile, false); err == nil {
+		t.Errorf("mismatched certificate and key accepted")
+	}
+}
+
+// Certificates expiring within the threshold are warned of;
+// only the first connection to a host is recorded.
+func TestCertsReport(t *testing.T) {
+	soon, _ := testCert(t, "soon.txstate.edu", time.Now().Add(10*24*time.Hour+time.Hour))
+	later, _ := testCert(t, "later.txstate.edu", time.Now().Add(100*24*time.Hour+time.Hour))
+	expired, _ := testCert(t, "expired.txstate.edu", time.Now().Add(-48*time.Hour))
+	c := NewCerts(30)
+	c.Add("soon.txstate.edu", &tls.ConnectionState{Version: tls.VersionTLS12, CipherSuite: tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, PeerCertificates: []*x509.Certificate{soon}})
+	c.Add("soon.txstate.edu", &tls.ConnectionState{Version: tls.VersionTLS10, PeerCertificates: []*x509.Certificate{later}})
+	c.Add("later.txstate.edu", &tls.ConnectionState{Version: 0x0304, CipherSuite: 0x1301, PeerCertificates: []*x509.Certificate{later}})
+	c.Add("expired.txstate.edu", &tls.ConnectionState{Version: tls.VersionTLS12, CipherSuite: 0xfefe, PeerCertificates: []*x509.Certificate{expired}})
+	c.Add("www.txstate.edu", nil)
+	tl := &testLog{}
+	c.Report(tl.logger())
+
+	want := map[string][4]interface{}{
+		"expired.txstate.edu": {"TLS1.2", "0xFEFE", "expired.txstate.edu", -2},
+		"later.txstate.edu":   {"TLS1.3", "TLS_AES_128_GCM_SHA256", "later.txstate.edu", 100},
+		"soon.txstate.edu":    {"TLS1.2", "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", "soon.txstate.edu", 10},
+	}
+	entries := tl.find("tls")
+	if len(entries) != len(want) {
+		t.Fatalf("%d tls entries, want %d", len(entries), len(want))
+	}
+	for _, ctx := range entries {
+		w := want[ctx["host"].(string)]
+		got := [4]interface{}{ctx["version"], ctx["cipher"], ctx["subject"], ctx["days"]}
+		if got != w {
+			t.Errorf("%v: tls %v, want %v", ctx["host"], got, w)
+		}
+	}
+	var warned []string
+	for _, ctx := range tl.find("cert-expiry") {
+		warned = append(warned, ctx["host"].(string))
+	}
+	if len(warned) != 2 || warned[0] != "expired.txstate.edu" || warned[1] != "soon.txstate.edu" {
+		t.Errorf("cert-expiry warnings for %v, want expired and soon hosts", warned)
+	}
+}
+
+// The certificate of a crawled https host is recorded.
+func TestCertsCrawl(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(`<html><body>ok</body></html>`))
+	}))
+	defer ts.Close()
+	envs := testEnvs(t, regexp.QuoteMeta(ts.URL))
+	envs.tlsconf = &tls.Config{InsecureSkipVerify: true}
+	testCrawl(envs, 1, ts.URL+"/")
+	tl := &testLog{}
+	envs.certs.Report(tl.logger())
+	entries := tl.find("tls")
+	if len(entries) != 1 || entries[0]["version"] == "" || entries[0]["cipher"] == "" {
+		t.Errorf("tls entries %v, want one for the crawled host", entries)
+	}
+	if len(tl.find("cert-expiry")) != 0 {
+		t.Errorf("test server certificate reported as expiring")
+	}
+}
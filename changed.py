@@ -0,0 +1,28 @@
+#!/usr/bin/python3
+# changed.py lists pages whose content hash differs
+# between two thrawler json logs; such as before and
+# after a Gato update. Pages that were only fetched in
+# one of the runs are left to link list comparisons.
+# Example usage:
+#   ./changed.py before.json after.json > pages.changed.txt
+import sys, json
+
+
+def hashes(name):
+  pages = {}
+  with open(name) as f:
+    for line in f:
+      data = json.loads(line)
+      if data.get("msg") == "req" and data.get("hash", "") != "":
+        pages[data["url"]] = data["hash"]
+  return pages
+
+if len(sys.argv) != 3:
+  print("USAGE: " + sys.argv[0] + " before.json after.json", file=sys.stderr)
+  sys.exit(1)
+
+before = hashes(sys.argv[1])
+after = hashes(sys.argv[2])
+for url in sorted(before):
+  if url in after and before[url] != after[url]:
+    print(url + "\t" + before[url] + "\t" + after[url])
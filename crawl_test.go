@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// skewedSite serves a site of pages linking to five other
+// pages and five images each; every twentieth page also links
+// a slow image. Requests take delay, and slow images take slow;
+// so threads stuck on slow images hold up the crawl unless idle
+// threads pick up the remaining links.
+func skewedSite(pages int, delay time.Duration, slow time.Duration) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/slow/") {
+			time.Sleep(slow)
+		} else {
+			time.Sleep(delay)
+		}
+		if !strings.HasPrefix(r.URL.Path, "/p/") && r.URL.Path != "/" {
+			w.Header().Set("Content-Type", "image/png")
+			return
+		}
+		n, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/p/"))
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, "<html><body>")
+		for k := 1; k <= 5; k++ {
+			fmt.Fprintf(w, `<a href="/p/%d">page</a><img src="/i/%d.png" alt="">`, (n*13+k)%pages, (n*5+k)%(pages*5))
+		}
+		if n%20 == 0 {
+			fmt.Fprintf(w, `<img src="/slow/%d.png" alt="">`, n)
+		}
+		fmt.Fprint(w, "</body></html>")
+	}))
+}
+
+// crawlSite crawls the site with a number of threads.
+func crawlSite(t testing.TB, ts *httptest.Server, threads int) *testLog {
+	envs := testEnvs(t, "^"+regexp.QuoteMeta(ts.URL)+"($|/)")
+	return testCrawl(envs, threads, ts.URL+"/")
+}
+
+// Each url is requested once, whatever the number of threads;
+// links found while another thread requests their url are
+// logged with its status once recorded.
+func TestCrawlThreads(t *testing.T) {
+	ts := skewedSite(200, 0, 10*time.Millisecond)
+	defer ts.Close()
+	var want []string
+	for _, threads := range []int{1, 4, 16} {
+		tl := crawlSite(t, ts, threads)
+		requested := make(map[string]int)
+		var reqs []string
+		for _, ctx := range tl.find("req") {
+			if ctx["net"] == true {
+				requested[ctx["url"].(string)]++
+			}
+			reqs = append(reqs, fmt.Sprintf("%v %v %v %v", ctx["src"], ctx["tag"], ctx["url"], ctx["code"]))
+		}
+		for url, n := range requested {
+			if n != 1 {
+				t.Errorf("threads %d: %s requested %d times", threads, url, n)
+			}
+		}
+		sort.Strings(reqs)
+		if want == nil {
+			want = reqs
+		} else if strings.Join(reqs, "\n") != strings.Join(want, "\n") {
+			t.Errorf("threads %d: %d req entries differ from those of 1 thread (%d)", threads, len(reqs), len(want))
+		}
+	}
+	if len(want) == 0 {
+		t.Error("nothing crawled")
+	}
+}
+
+// BenchmarkCrawl measures the throughput of crawls of a site
+// with a few slow images, by the number of threads; e.g. with
+// Go 1.12 or newer,
+//   go test -run NONE -bench Crawl -benchtime 3x .
+func BenchmarkCrawl(b *testing.B) {
+	ts := skewedSite(400, 2*time.Millisecond, 300*time.Millisecond)
+	defer ts.Close()
+	for _, threads := range []int{1, 4, 8, 16} {
+		b.Run(fmt.Sprintf("threads=%d", threads), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				crawlSite(b, ts, threads)
+			}
+		})
+	}
+}
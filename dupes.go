@@ -0,0 +1,111 @@
+// Duplicate content detection (dupes)
+package main
+
+import (
+	log "gopkg.in/inconshreveable/log15.v2"
+	"regexp"
+	"sort"
+	"sync"
+)
+
+// Duplicates groups the canonical urls of fetched html
+// pages by their content hash; so that pages reachable
+// under more than one url may be reported at the end of
+// the crawl. It is shared by all threads.
+type Duplicates struct {
+	mu    *sync.Mutex
+	pages map[string][]string
+}
+
+func NewDuplicates() Duplicates {
+	return Duplicates{mu: &sync.Mutex{}, pages: make(map[string][]string)}
+}
+
+// Add records the content hash of a page.
+func (d Duplicates) Add(hash string, url string) {
+	if d.pages == nil {
+		return
+	}
+	d.mu.Lock()
+	d.pages[hash] = append(d.pages[hash], url)
+	d.mu.Unlock()
+}
+
+// Report logs a duplicate-content entry for each cluster of
+// distinct urls serving identical content, along with the
+// suggested config file find/replace rules that would
+// rewrite the other urls to the cluster's shortest url.
+func (d Duplicates) Report(l log.Logger) {
+	if d.pages == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var hashes []string
+	for hash, urls := range d.pages {
+		if len(urls) > 1 {
+			hashes = append(hashes, hash)
+		}
+	}
+	sort.Strings(hashes)
+	for _, hash := range hashes {
+		urls := d.pages[hash]
+		sort.Slice(urls, func(i, j int) bool {
+			if len(urls[i]) != len(urls[j]) {
+				return len(urls[i]) < len(urls[j])
+			}
+			return urls[i] < urls[j]
+		})
+		var rules []string
+		seen := make(map[string]bool)
+		for _, url := range urls[1:] {
+			if rule := SuggestRule(url, urls[0]); rule != "" && !seen[rule] {
+				seen[rule] = true
+				rules = append(rules, rule)
+			}
+		}
+		l.Warn("duplicate-content", "hash", hash, "url", urls[0], "urls", urls[1:], "rules", rules)
+	}
+}
+
+// SuggestRule returns a tab delimited config file find/replace
+// rule that rewrites the url from into the url to. Rules are
+// generalized to the whole host when only the protocol or host
+// differs, or when the urls only differ at the end of the path;
+// such as an .html extension. Otherwise the rule only applies to
+// the single url.
+func SuggestRule(from string, to string) string {
+	f := reSplitUrl.FindStringSubmatch(from)
+	t := reSplitUrl.FindStringSubmatch(to)
+	if len(f) == 0 || len(t) == 0 {
+		return ""
+	}
+	fpath, tpath := f[3]+f[4], t[3]+t[4]
+	if fpath == tpath {
+		if f[2] == t[2] {
+			// Only the protocol differs
+			return "^" + f[1] + "://" + regexp.QuoteMeta(f[2]) + "($|/)\t" + t[1] + "://" + t[2] + "${1}"
+		}
+		// Only the host differs
+		return "^(https?:)//" + regexp.QuoteMeta(f[2]) + "($|/)\t${1}//" + t[2] + "${2}"
+	}
+	if f[1] != t[1] || f[2] != t[2] {
+		return "^" + regexp.QuoteMeta(from) + "$\t" + to
+	}
+	// Same host; find the differing middle of the paths.
+	p := 0
+	for p < len(fpath) && p < len(tpath) && fpath[p] == tpath[p] {
+		p++
+	}
+	s := 0
+	for s < len(fpath)-p && s < len(tpath)-p && fpath[len(fpath)-1-s] == tpath[len(tpath)-1-s] {
+		s++
+	}
+	a, b := fpath[p:len(fpath)-s], tpath[p:len(tpath)-s]
+	host := "^(https?://" + regexp.QuoteMeta(f[2])
+	if s == 0 && a != "" {
+		// Differ at the end of the path; e.g. .html extensions
+		return host + "/.*)" + regexp.QuoteMeta(a) + "$\t${1}" + b
+	}
+	return host + regexp.QuoteMeta(fpath[:p]) + ")" + regexp.QuoteMeta(a) + "(" + regexp.QuoteMeta(fpath[len(fpath)-s:]) + ")$\t${1}" + b + "${2}"
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// applyRule rewrites a url with a tab delimited find/replace
+// rule, the same as a config file rule.
+func applyRule(t *testing.T, rule string, url string) string {
+	fields := strings.Split(rule, "\t")
+	if len(fields) != 2 {
+		t.Fatalf("rule %q is not tab delimited", rule)
+	}
+	return regexp.MustCompile(fields[0]).ReplaceAllString(url, fields[1])
+}
+
+func TestSuggestRule(t *testing.T) {
+	tests := []struct {
+		from, to string
+		rule     string
+		// Another url the rule should rewrite, and its rewrite
+		other, rewrite string
+	}{
+		{
+			"http://www.txstate.edu/about", "https://www.txstate.edu/about",
+			"^http://www\\.txstate\\.edu($|/)\thttps://www.txstate.edu${1}",
+			"http://www.txstate.edu/news", "https://www.txstate.edu/news",
+		},
+		{
+			"http://txstate.edu/about", "http://www.txstate.edu/about",
+			"^(https?:)//txstate\\.edu($|/)\t${1}//www.txstate.edu${2}",
+			"https://txstate.edu/", "https://www.txstate.edu/",
+		},
+		{
+			"http://www.txstate.edu/about.html", "http://www.txstate.edu/about",
+			"^(https?://www\\.txstate\\.edu/.*)\\.html$\t${1}",
+			"http://www.txstate.edu/news/today.html", "http://www.txstate.edu/news/today",
+		},
+		{
+			"http://www.txstate.edu/index/news/", "http://www.txstate.edu/news/",
+			"^(https?://www\\.txstate\\.edu/)index/(news/)$\t${1}${2}",
+			"http://www.txstate.edu/index/events/", "http://www.txstate.edu/index/events/",
+		},
+		{
+			"http://old.txstate.edu/a", "http://www.txstate.edu/b",
+			"^http://old\\.txstate\\.edu/a$\thttp://www.txstate.edu/b",
+			"http://old.txstate.edu/c", "http://old.txstate.edu/c",
+		},
+	}
+	for _, test := range tests {
+		rule := SuggestRule(test.from, test.to)
+		if rule != test.rule {
+			t.Errorf("SuggestRule(%q, %q) = %q, want %q", test.from, test.to, rule, test.rule)
+			continue
+		}
+		if got := applyRule(t, rule, test.from); got != test.to {
+			t.Errorf("rule %q rewrites %q to %q, want %q", rule, test.from, got, test.to)
+		}
+		if got := applyRule(t, rule, test.other); got != test.rewrite {
+			t.Errorf("rule %q rewrites %q to %q, want %q", rule, test.other, got, test.rewrite)
+		}
+	}
+	if rule := SuggestRule("mailto:web@txstate.edu", "http://www.txstate.edu/"); rule != "" {
+		t.Errorf("SuggestRule of a non-http url = %q", rule)
+	}
+}
+
+// Soft 404 pages served under distinct urls share a template;
+// they are not reported as duplicate content.
+func TestDuplicatesSkipSoft404(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		switch r.URL.Path {
+		case "/":
+			fmt.Fprint(w, `<html><body><a href="/a">a</a><a href="/a.html">a</a><a href="/gone">gone</a><a href="/missing">missing</a></body></html>`)
+		case "/a", "/a.html":
+			fmt.Fprint(w, `<html><head><title>A</title></head><body>a</body></html>`)
+		default:
+			fmt.Fprint(w, `<html><head><title>Page Not Found</title></head><body>not found</body></html>`)
+		}
+	}))
+	defer ts.Close()
+	envs := testEnvs(t, "^"+regexp.QuoteMeta(ts.URL))
+	if err := envs.soft404.Parse([]string{"title", "^Page Not Found"}); err != nil {
+		t.Fatal(err)
+	}
+	tl := testCrawl(envs, 4, ts.URL+"/")
+	if n := len(tl.find("soft-404")); n != 2 {
+		t.Errorf("%d soft-404 entries, want 2", n)
+	}
+	dl := &testLog{}
+	envs.dupes.Report(dl.logger())
+	dupes := dl.find("duplicate-content")
+	if len(dupes) != 1 || dupes[0]["url"] != ts.URL+"/a" {
+		t.Errorf("duplicate-content entries %v, want only %s/a", dupes, ts.URL)
+	}
+}
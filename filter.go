@@ -3,13 +3,15 @@ package main
 
 import (
 	"bytes"
+	"crypto/tls"
+	"encoding/json"
 	"fmt"
 	"golang.org/x/net/html"
 	log "gopkg.in/inconshreveable/log15.v2"
-	"io"
-	"io/ioutil"
 	"net/http"
+	"net/url"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -23,10 +25,24 @@ const (
 	CSSFILTER
 )
 
+// Mixed content severities of http: subresources
+// referenced from https: pages. Active mixed content
+// (scripts, stylesheets, iframes) is blocked by browsers,
+// while passive mixed content (images, media) is only
+// flagged as insecure. Links that do not load a
+// subresource, such as a tags, are NOTMIXED.
+const (
+	NOTMIXED     = ""
+	PASSIVEMIXED = "passive"
+	ACTIVEMIXED  = "active"
+)
+
 type LinkContent struct {
 	Url    string
 	Tag    string
 	Filter FilterType
+	Mixed  string
+	Kind   string
 }
 
 // NOTE: Use of reCSS regular expresson is required to
@@ -46,6 +62,7 @@ var reSRCSET = regexp.MustCompile(`\b(https?://[^ ,]+)`)
 var reFullUrl = regexp.MustCompile(`^https?://`)
 var reSplitUrl = regexp.MustCompile(`^(https?)://([^/]+)(/[^?#]*)?(\?[^#]*)?(#.*)?$`)
 var reProtocol = regexp.MustCompile(`^[^/:]+:`)
+var reHttpUrl = regexp.MustCompile(`(?i)^http:`)
 
 type ErrFragmentUrl struct {
 	hash string
@@ -115,34 +132,70 @@ func (e ErrNotHtmlContent) Error() string {
 	return fmt.Sprintf("Not html Content-Type: '%s'", e.content)
 }
 
-type Header struct {
-	Name string
-	Val  string
+type ErrUnexpectedContentType struct {
+	kind    string
+	content string
+}
+
+func (e ErrUnexpectedContentType) Error() string {
+	return fmt.Sprintf("Unexpected Content-Type for %s: '%s'", e.kind, e.content)
 }
 
-type Env map[string]int
+type ErrMissingContentType struct {
+	kind string
+}
+
+func (e ErrMissingContentType) Error() string {
+	return fmt.Sprintf("Missing Content-Type for %s", e.kind)
+}
 
 type Envs struct {
-	envs    []Env
-	headers []Header
-	canon   Canon
-	crawl   bool
+	visited    *Visited
+	headers    Headers
+	profile    string
+	canon      Canon
+	crawl      bool
+	nthchild   bool
+	soft404    Soft404
+	forbidden  Forbiddens
+	volatile   Volatiles
+	asserts    Asserts
+	access     bool
+	dupes      Duplicates
+	canonicals Canonicals
+	timings    *Timings
+	weights    *Weights
+	tlsconf    *tls.Config
+	certs      *Certs
+	heads      *Heads
+	retries    Retries
+	proxy      func(*http.Request) (*url.URL, error)
+	resolve    Resolves
+	auths      Auths
+	jar        *Jar
+	bodies     Bodies
+	recorder   *Recorder
+	replay     *Replay
+	scopes     *Scopes
+	boosts     Boosts
 }
 
-func StartHtmlFilterLinks(envn int, headers []Header, canon Canon, crawl bool, urls []string) (pis []ProcInfo) {
-	es := make([]Env, envn)
-	for i := 0; i < envn; i++ {
-		es[i] = make(Env)
-	}
-	var envs = Envs{envs: es, headers: headers, canon: canon, crawl: crawl}
-	for _, url := range urls {
+// StartHtmlFilterLinks generates the initial list of
+// HtmlFilterLinks to process from the seed urls.
+func StartHtmlFilterLinks(envs Envs, urls []string) (pis []ProcInfo) {
+	for _, seed := range urls {
+		// Links found crawling from a seed inherit
+		// the header profile the seed selected.
+		url, profile := splitSeed(seed)
 		if reFullUrl.MatchString(url) {
-			li, err := canon(LinkInfo{}, url)
+			li, err := envs.canon(LinkInfo{}, url)
 			if err == nil {
-				if !crawl {
-					es[ChannelPicker(li.String(), envn)][li.String()] = -1
+				if !envs.crawl {
+					envs.visited.Seed(li.String())
 				}
-				pis = append(pis, ProcInfo(HtmlFilterLink{LinkInfo: li, Envs: envs}))
+				seedEnvs := envs
+				seedEnvs.profile = profile
+				pis = append(pis, ProcInfo(HtmlFilterLink{LinkInfo: li, Envs: seedEnvs}))
 			}
 		}
 	}
@@ -156,6 +209,7 @@ type LinkInfo struct {
 	Query    string
 	Fragment string
 	Tag      string
+	Kind     string
 	Initial  string
 	FullUrl  string
 }
@@ -175,10 +229,21 @@ func (li LinkInfo) GetUrl() string {
 type Links struct {
 	LinkInfo
 	Envs
-	source string
-	list   []LinkInfo
-	htm    *html.Tokenizer
-	log    log.Logger
+	source  string
+	list    []LinkInfo
+	log     log.Logger
+	attempt int
+	depth   int
+	reqid   string
+}
+
+// newLinks returns the Links used to process a link; retried
+// links also log the attempt number of the request.
+func newLinks(l log.Logger, li LinkInfo, envs Envs, source string, attempt int, depth int) *Links {
+	if attempt > 0 {
+		l = l.New("attempt", attempt+1)
+	}
+	return &Links{LinkInfo: li, Envs: envs, source: source, log: l, attempt: attempt, depth: depth}
 }
 
 // A links require use of MIME to determine what
@@ -196,12 +261,14 @@ type Links struct {
 type HtmlFilterLink struct {
 	LinkInfo
 	Envs
-	source string
+	source  string
+	attempt int
+	depth   int
 }
 
 func (link HtmlFilterLink) Fn(l log.Logger, i int) []ProcInfo {
-	ls := &Links{LinkInfo: link.LinkInfo, Envs: link.Envs, source: link.source, log: l}
-	return ls.Request(i, HTMLFILTER)
+	ls := newLinks(l, link.LinkInfo, link.Envs, link.source, link.attempt, link.depth)
+	return ls.Request(HTMLFILTER)
 }
 
 // link tag and rel="stylesheet" href="<url>"
@@ -210,12 +277,14 @@ func (link HtmlFilterLink) Fn(l log.Logger, i int) []ProcInfo {
 type CssFilterLink struct {
 	LinkInfo
 	Envs
-	source string
+	source  string
+	attempt int
+	depth   int
 }
 
 func (link CssFilterLink) Fn(l log.Logger, i int) []ProcInfo {
-	ls := &Links{LinkInfo: link.LinkInfo, Envs: link.Envs, source: link.source, log: l}
-	return ls.Request(i, CSSFILTER)
+	ls := newLinks(l, link.LinkInfo, link.Envs, link.source, link.attempt, link.depth)
+	return ls.Request(CSSFILTER)
 }
 
 // We should use only HEAD requests for the following links
@@ -231,15 +300,72 @@ func (link CssFilterLink) Fn(l log.Logger, i int) []ProcInfo {
 // 3) Script link from script tag type="text/javascript"
 //   attribute should also return the
 //   "content-type:application/javascript" header
+// Expected content types are verified against the
+// expectedContent table by the kind of link.
 type ExistOnlyLink struct {
 	LinkInfo
 	Envs
-	source string
+	source  string
+	attempt int
+	depth   int
 }
 
 func (link ExistOnlyLink) Fn(l log.Logger, i int) []ProcInfo {
-	ls := &Links{LinkInfo: link.LinkInfo, Envs: link.Envs, source: link.source, log: l}
-	return ls.Request(i, EXISTFILTER)
+	ls := newLinks(l, link.LinkInfo, link.Envs, link.source, link.attempt, link.depth)
+	return ls.Request(EXISTFILTER)
+}
+
+type ErrNotSpillable struct {
+	proc string
+}
+
+func (e ErrNotSpillable) Error() string {
+	return fmt.Sprintf("Can not spill to disk: '%s'", e.proc)
+}
+
+// spilledLink is the encoding of a link spilled to disk. The
+// link's Envs are those of the run, apart from the header
+// profile of the seed it was found from.
+type spilledLink struct {
+	Filter  FilterType
+	Link    LinkInfo
+	Source  string
+	Attempt int
+	Depth   int
+	Profile string
+}
+
+// Encode encodes a link so that it may be spilled to disk
+// when the frontier is full.
+func (e Envs) Encode(pi ProcInfo) ([]byte, error) {
+	var sl spilledLink
+	switch link := pi.(type) {
+	case HtmlFilterLink:
+		sl = spilledLink{Filter: HTMLFILTER, Link: link.LinkInfo, Source: link.source, Attempt: link.attempt, Depth: link.depth, Profile: link.profile}
+	case CssFilterLink:
+		sl = spilledLink{Filter: CSSFILTER, Link: link.LinkInfo, Source: link.source, Attempt: link.attempt, Depth: link.depth, Profile: link.profile}
+	case ExistOnlyLink:
+		sl = spilledLink{Filter: EXISTFILTER, Link: link.LinkInfo, Source: link.source, Attempt: link.attempt, Depth: link.depth, Profile: link.profile}
+	default:
+		return nil, ErrNotSpillable{proc: pi.String()}
+	}
+	return json.Marshal(sl)
+}
+
+// Decode decodes a link spilled to disk by Encode.
+func (e Envs) Decode(b []byte) (ProcInfo, error) {
+	var sl spilledLink
+	if err := json.Unmarshal(b, &sl); err != nil {
+		return nil, err
+	}
+	e.profile = sl.Profile
+	switch sl.Filter {
+	case HTMLFILTER:
+		return HtmlFilterLink{LinkInfo: sl.Link, Envs: e, source: sl.Source, attempt: sl.Attempt, depth: sl.Depth}, nil
+	case CSSFILTER:
+		return CssFilterLink{LinkInfo: sl.Link, Envs: e, source: sl.Source, attempt: sl.Attempt, depth: sl.Depth}, nil
+	}
+	return ExistOnlyLink{LinkInfo: sl.Link, Envs: e, source: sl.Source, attempt: sl.Attempt, depth: sl.Depth}, nil
 }
 
 // Currently no redirects are taken
@@ -252,70 +378,184 @@ func redirectPolicyFunc(_ *http.Request, _ []*http.Request) error {
 	return ErrRedirectTtlExceeded{}
 }
 
+// NewClient returns the http client used for all
+// requests made by thrawler.
+func (e Envs) NewClient() *http.Client {
+	// Magnolia CMS gzip responses have a 2GB limit;
+	// so do not accept gzip content to avoid issue.
+	// WARNING: Also it seems that apache is not
+	// filtering some of the mj marked links when
+	// compression is used. TODO: Verify this issue.
+	// Compression is only requested, and decoded by
+	// Bodies, when the --compress option is given.
+	// Each request has its own transport, so connections
+	// are not kept alive only to be left open.
+	tr := &http.Transport{
+		DisableCompression: true,
+		DisableKeepAlives:  true,
+		TLSClientConfig:    e.tlsconf,
+		Proxy:              e.proxy,
+		DialContext:        e.resolve.DialContext,
+	}
+	var base http.RoundTripper = tr
+	if e.replay != nil {
+		base = e.replay
+	}
+	client := &http.Client{
+		Timeout:       time.Duration(180 * time.Second),
+		CheckRedirect: redirectPolicyFunc,
+		Transport:     e.auths.Transport(e.recorder.Transport(base)),
+	}
+	if e.jar != nil {
+		client.Jar = e.jar
+	}
+	return client
+}
+
+// NewRequest returns a request for the link with the referer
+// and configured headers added. Existence checks made with a
+// GET request only request the first byte of the resource.
+func (ls *Links) NewRequest(method string, f FilterType) (*http.Request, error) {
+	req, err := http.NewRequest(method, ls.String(), nil)
+	if err != nil {
+		return req, err
+	}
+	if ls.source != "" {
+		req.Header.Add("referer", ls.source)
+	}
+	ls.reqid = ls.headers.Add(req, ls.profile, ls.source)
+	if method == "GET" && f == EXISTFILTER {
+		req.Header.Set("Range", "bytes=0-0")
+	}
+	ls.bodies.Accept(req)
+	return req, nil
+}
+
+// contentRangeLength returns the complete length of a resource
+// from a Content-Range header, e.g. "bytes 0-0/1234"; or -1
+// if the length is unknown.
+func contentRangeLength(cr string) int64 {
+	if i := strings.LastIndex(cr, "/"); i >= 0 {
+		if n, err := strconv.ParseInt(cr[i+1:], 10, 64); err == nil {
+			return n
+		}
+	}
+	return -1
+}
+
+// method returns the request method used for a filter;
+// only existence checks are made with HEAD requests.
+func (ls *Links) method(f FilterType) string {
+	if f == HTMLFILTER || f == CSSFILTER || ls.heads.Unreliable(ls.Host) {
+		return "GET"
+	}
+	return "HEAD"
+}
+
 // Request method handles all logging of results
 // and as a result handles all errors as well.
 //func Request(l log.Logger, i int, e Envs, src string, li LinkInfo, filter func(log.Logger, io.Reader, Envs, LinkInfo, func(LinkInfo, string) (LinkInfo, error)) ([]ProcInfo, error)) []ProcInfo {
-func (ls *Links) Request(i int, f FilterType) []ProcInfo {
+func (ls *Links) Request(f FilterType) []ProcInfo {
 	var pis = []ProcInfo{}
-	stat, ok := ls.envs[i][ls.String()]
-	if !ls.crawl { // Non-crawling modified behavior
-		if ok && stat == -1 { // First time handling submitted page; always parse submitted pages.
-			ok = false
-			f = HTMLFILTER
-		} else if !ok && f == HTMLFILTER { // Non-submitted normally to be parsed pages; do not parse
-			f = EXISTFILTER
-		}
-		// let rest fall through such as:
-		// - Submitted pages that have already been parsed
-		// - Non-submitted pages that normally do not require parsing
-	}
-	method := "HEAD"
-	if f == HTMLFILTER || f == CSSFILTER {
-		method = "GET"
+	var stat int
+	var ok, pending bool
+	// Retried links have already claimed their url, and are
+	// retried with the filter first decided upon.
+	if ls.attempt == 0 {
+		// Links whose url is being requested by another thread
+		// are logged once the other thread records its status.
+		stat, ok, pending = ls.visited.Claim(ls.String(), func(stat int) {
+			ls.log.Info("req", "src", ls.source, "tag", ls.Tag, "url", ls.String(), "initial", ls.Initial, "err", "", "code", stat, "type", ls.method(f), "net", false)
+		})
+		if pending {
+			return pis
+		}
+		if !ls.crawl { // Non-crawling modified behavior
+			if !ok && stat == -1 { // First time handling submitted page; always parse submitted pages.
+				f = HTMLFILTER
+			} else if !ok && f == HTMLFILTER { // Non-submitted normally to be parsed pages; do not parse
+				f = EXISTFILTER
+			}
+			// let rest fall through such as:
+			// - Submitted pages that have already been parsed
+			// - Non-submitted pages that normally do not require parsing
+		}
+		if !ok && f == HTMLFILTER {
+			// Pages cut by a depth, page count or scope budget are
+			// only checked to exist; the same as when not crawling.
+			if reason, rule := ls.scopes.Admit(ls.LinkInfo, ls.depth); reason != "" {
+				ls.log.Info("cut", "src", ls.source, "tag", ls.Tag, "url", ls.String(), "reason", reason, "rule", rule, "depth", ls.depth)
+				f = EXISTFILTER
+			}
+		}
 	}
+	method := ls.method(f)
 	if ok { // Only log pages that have already been handled
 		ls.log.Info("req", "src", ls.source, "tag", ls.Tag, "url", ls.String(), "initial", ls.Initial, "err", "", "code", stat, "type", method, "net", false)
 		return pis
 	}
-	req, err := http.NewRequest(method, ls.String(), nil)
+	req, err := ls.NewRequest(method, f)
 	if err != nil {
-		ls.envs[i][ls.String()] = 0
+		ls.visited.Set(ls.String(), 0)
 		ls.log.Info("req", "src", ls.source, "tag", ls.Tag, "url", ls.String(), "initial", ls.Initial, "err", err.Error(), "code", 0, "type", method, "net", true)
 		return pis
 	}
 
-	// Magnolia CMS gzip responses have a 2GB limit;
-	// so do not accept gzip content to avoid issue.
-	// WARNING: Also it seems that apache is not
-	// filtering some of the mj marked links when
-	// compression is used. TODO: Verify this issue.
-	tr := &http.Transport{
-		DisableCompression: true,
-	}
-
-	if ls.source != "" {
-		req.Header.Add("referer", ls.source)
-	}
-	if len(ls.headers) > 0 {
-		for _, h := range ls.headers {
-			req.Header.Add(h.Name, h.Val)
+	req, timing := NewTiming(req)
+	res, err := ls.NewClient().Do(req)
+	// Some endpoints, such as imagehandler and external CDNs,
+	// reject HEAD requests; so retry them with a ranged GET
+	// and remember the host's HEAD responses are unreliable.
+	if err == nil && method == "HEAD" && ls.heads.Fallback(res.StatusCode) {
+		head := res.StatusCode
+		res.Body.Close()
+		res = nil
+		method = "GET"
+		ls.log = ls.log.New("head", head)
+		if req, err = ls.NewRequest(method, f); err == nil {
+			req, timing = NewTiming(req)
+			res, err = ls.NewClient().Do(req)
+			if err == nil && (res.StatusCode == 200 || res.StatusCode == 206) {
+				ls.heads.MarkUnreliable(ls.log, ls.Host, ls.String(), head)
+			}
 		}
 	}
-	client := &http.Client{
-		Timeout:       time.Duration(180 * time.Second),
-		CheckRedirect: redirectPolicyFunc,
-		Transport:     tr,
+	if err == nil && f == EXISTFILTER && res.StatusCode == 206 {
+		// A partial response to a ranged GET means the resource
+		// exists; so treat it the same as a full response.
+		res.StatusCode = 200
+		res.ContentLength = contentRangeLength(res.Header.Get("Content-Range"))
 	}
-
-	res, err := client.Do(req)
 	if res != nil {
 		defer res.Body.Close()
+		if res.TLS != nil {
+			ls.certs.Add(ls.Host, res.TLS)
+		}
+	}
+	// Transient failures, such as timeouts or a 503 during a
+	// deploy, are queued again after a backoff delay rather
+	// than being recorded as the link's final status.
+	if delay, retry := ls.retries.Retry(ls.attempt, res, err); retry {
+		var statusCode int
+		var errstr string
+		if res != nil {
+			statusCode = res.StatusCode
+		}
+		if err != nil {
+			errstr = err.Error()
+		}
+		rl := ls.Timed(f, method, timing)
+		if ls.attempt == 0 { // Retried links already log their attempt
+			rl = rl.New("attempt", 1)
+		}
+		rl.Warn("retry", "src", ls.source, "tag", ls.Tag, "url", ls.String(), "err", errstr, "code", statusCode, "type", method, "delay_ms", ms(delay))
+		return []ProcInfo{ls.Retry(f, delay)}
 	}
 
 	if res == nil || res.StatusCode == -1 {
-		ls.envs[i][ls.String()] = 0
+		ls.visited.Set(ls.String(), 0)
 	} else {
-		ls.envs[i][ls.String()] = res.StatusCode
+		ls.visited.Set(ls.String(), res.StatusCode)
 	}
 	if err != nil || res.StatusCode != 200 {
 		// could be redirect error ErrRedirectTtlExceeded
@@ -324,39 +564,82 @@ func (ls *Links) Request(i int, f FilterType) []ProcInfo {
 		if res != nil {
 			statusCode = res.StatusCode
 		}
+		tl := ls.Timed(f, method, timing)
 		if err != nil {
-			ls.log.Info("req", "src", ls.source, "tag", ls.Tag, "url", ls.String(), "initial", ls.Initial, "err", err.Error(), "code", statusCode, "type", method, "net", true)
+			tl.Info("req", "src", ls.source, "tag", ls.Tag, "url", ls.String(), "initial", ls.Initial, "err", err.Error(), "code", statusCode, "type", method, "net", true)
 		} else {
-			ls.log.Info("req", "src", ls.source, "tag", ls.Tag, "url", ls.String(), "initial", ls.Initial, "err", "", "code", statusCode, "type", method, "net", true)
+			tl.Info("req", "src", ls.source, "tag", ls.Tag, "url", ls.String(), "initial", ls.Initial, "err", "", "code", statusCode, "type", method, "net", true)
 		}
 		return pis
 	}
 
 	if f == EXISTFILTER { // Implies HEAD Request Method
-		ls.log.Info("req", "src", ls.source, "tag", ls.Tag, "url", ls.String(), "initial", ls.Initial, "err", "", "code", res.StatusCode, "type", method, "net", true)
+		// Verify the resource is of the type expected by the
+		// tag that linked to it; e.g. catch Magnolia serving an
+		// html error page with a 200 status in place of an image.
+		tl := ls.Timed(f, method, timing)
+		ls.weights.Size(ls.String(), res.ContentLength, res.Header.Get("Content-Type"))
+		if err := CheckContentType(ls.Kind, res.Header.Get("Content-Type")); err != nil {
+			tl.Info("req", "src", ls.source, "tag", ls.Tag, "url", ls.String(), "initial", ls.Initial, "err", err.Error(), "code", res.StatusCode, "type", method, "net", true)
+		} else {
+			tl.Info("req", "src", ls.source, "tag", ls.Tag, "url", ls.String(), "initial", ls.Initial, "err", "", "code", res.StatusCode, "type", method, "net", true)
+		}
 	} else if f != SKIPFILTER {
+		var hash string
+		var body []byte
 		var err error
-		if f == HTMLFILTER { // Implies GET Request Method with HTML Filter
+		// Only html and css responses are read and hashed;
+		// other content linked from a tags, such as pdfs or
+		// videos, is closed without being downloaded.
+		content := res.Header.Get("Content-Type")
+		read := true
+		if f == HTMLFILTER && !strings.HasPrefix(strings.ToLower(strings.TrimSpace(content)), "text/html") {
 			// Only process response responses with "Content-Type: text/html;charset=UTF-8"
 			// As Gato seems to include links to images in a tags.
-			content := res.Header.Get("Content-Type")
-			if strings.HasPrefix(content, "text/html") {
-				pis, err = ls.FilterHtml(res.Body)
-			} else {
-				err = ErrNotHtmlContent{content: content}
+			err = ErrNotHtmlContent{content: content}
+			read = false
+		}
+		var wire int64
+		var truncated bool
+		if read {
+			body, wire, truncated, err = ls.bodies.Read(res)
+		}
+		tl := ls.Timed(f, method, timing)
+		if enc := res.Header.Get("Content-Encoding"); read && enc != "" {
+			tl = tl.New("encoding", enc, "wire_bytes", wire)
+		}
+		if truncated {
+			ls.log.Warn("truncated", "src", ls.source, "url", ls.String(), "content", content, "limit", len(body))
+		}
+		if read && err == nil {
+			ls.weights.Size(ls.String(), wire, content)
+			// Fingerprint content so that pages whose body
+			// changed between crawls may be found.
+			hash = ls.volatile.Hash(body)
+			if f == HTMLFILTER { // Implies GET Request Method with HTML Filter
+				ls.weights.Page(ls.String())
+				pis, err = ls.FilterHtml(body)
+				// Soft 404 pages share one template; so they
+				// are not grouped as duplicate content.
+				if _, soft404 := err.(ErrSoft404); !soft404 && len(body) > 0 {
+					ls.dupes.Add(hash, ls.String())
+				}
+			} else { // Implies GET Request Method with CSS Filter
+				// NOTE: html document specifies
+				// <link rel=stylesheet type=text/css ...>;
+				// so a stylesheet served with another
+				// Content-Type is reported, though still
+				// parsed for the url()s it references.
+				pis, err = ls.FilterCss(body)
+				if err == nil {
+					err = CheckContentType(ls.Kind, content)
+				}
 			}
-		} else { // Implies GET Request Method with CSS Filter
-			// NOTE: html document specifies
-			// <link rel=stylesheet type=text/css ...>;
-			// so checking the response Content-Type
-			// header is redundant and not required
-			// for browsers.
-			pis, err = ls.FilterCss(res.Body)
 		}
 		if err != nil {
-			ls.log.Info("req", "src", ls.source, "tag", ls.Tag, "url", ls.String(), "initial", ls.Initial, "err", err.Error(), "code", res.StatusCode, "type", method, "net", true)
+			tl.Info("req", "src", ls.source, "tag", ls.Tag, "url", ls.String(), "initial", ls.Initial, "err", err.Error(), "code", res.StatusCode, "type", method, "net", true, "hash", hash)
 		} else {
-			ls.log.Info("req", "src", ls.source, "tag", ls.Tag, "url", ls.String(), "initial", ls.Initial, "err", "", "code", res.StatusCode, "type", method, "net", true)
+			tl.Info("req", "src", ls.source, "tag", ls.Tag, "url", ls.String(), "initial", ls.Initial, "err", "", "code", res.StatusCode, "type", method, "net", true, "hash", hash)
 		}
 	}
 	return pis
@@ -375,182 +658,246 @@ func (ls *Links) Request(i int, f FilterType) []ProcInfo {
 //   If they are cached then:
 //     1) Pull relative links from cache
 //   Finally process any relative links with respect to source page
-func (ls *Links) FilterHtml(doc io.Reader) ([]ProcInfo, error) {
-	// The HTML parser does not handle Reader interfaces; so we
-	// must first turned the reader into a string, thus
-	// requiring us to retrieve the full page before we can
-	// start parsing.
+func (ls *Links) FilterHtml(body []byte) ([]ProcInfo, error) {
+	// The HTML parser builds the full document tree using the
+	// HTML5 tree-construction algorithm, thus requiring us to
+	// retrieve the full page before we can start walking it.
+	// This gives us the same implied structure a browser
+	// would see when optional end tags are omitted. Scripting
+	// is disabled, as for the tokenizer, so that the contents
+	// of noscript elements are parsed rather than left as text.
 	var procs []ProcInfo
-	var locs []string
-	ls.htm = html.NewTokenizer(doc)
-	for {
-		if tokenType := ls.htm.Next(); tokenType == html.ErrorToken {
-			if err := ls.htm.Err(); err == io.EOF {
-				return procs, nil
-			} else {
-				return procs, ErrMalformHtml{err: err.Error()}
+	ls.forbidden.Scan(ls.log, ls.source, ls.String(), body)
+	root, err := html.ParseWithOptions(bytes.NewReader(body), html.ParseOptionEnableScripting(false))
+	if err != nil {
+		return procs, ErrMalformHtml{err: err.Error()}
+	}
+	ls.asserts.Check(ls.log, ls.source, ls.String(), body, root)
+	// Do not crawl links from "page not found" content
+	// served with a 200 status.
+	if rule := ls.soft404.Match(ls.LinkInfo, htmlTitle(root), body); rule != "" {
+		ls.log.Warn("soft-404", "src", ls.source, "url", ls.String(), "rule", rule)
+		return procs, ErrSoft404{rule: rule}
+	}
+	if ls.access {
+		ls.Accessibility(root)
+	}
+	if ls.canonicals.urls != nil {
+		ls.Canonical(root)
+	}
+	walkHtml(root, nil, ls.nthchild, func(n *html.Node, locs []string) {
+		loc := strings.Join(locs, "/")
+		tag := n.Data
+		if ls.nthchild {
+			tag += nthChild(n)
+		}
+		var list []LinkContent
+		if n.Data == "style" {
+			// <style type="text/css"> ExistOnlyLink
+			links := parseCss(textContent(n))
+			for _, l := range links {
+				list = append(list, LinkContent{Url: l, Tag: loc + "/" + tag, Filter: EXISTFILTER, Mixed: PASSIVEMIXED, Kind: "style"})
 			}
-		} else {
-			switch tokenType {
-			case html.StartTagToken, html.SelfClosingTagToken:
-				var id string
-				var class string
-				tag, moreAttr := ls.htm.TagName()
-				var list []LinkContent
-				if bytes.Equal(tag, []byte("style")) {
-					// <style type="text/css"> ExistOnlyLink
-					text := ls.htm.Text()
-					links := parseCss(string(text))
-					for _, l := range links {
-						list = append(list, LinkContent{Url: l, Tag: strings.Join(locs, "/") + "/style", Filter: EXISTFILTER})
-					}
-				} else if moreAttr {
-					var attr []byte
-					var val []byte
-					var css string
-					var text_css bool
-					for moreAttr {
-						attr, val, moreAttr = ls.htm.TagAttr()
-						switch {
-						case bytes.Equal(attr, []byte("id")):
-							id = string(val)
-						case bytes.Equal(attr, []byte("class")):
-							class = string(val)
-						case bytes.Equal(attr, []byte("type")):
-							// <link rel="stylesheet" type="text/css" href="theme.css">
-							//   if type="text/css"  -> CssFilterLink
-							//   else -> ExistOnlyLink
-							if bytes.Equal(tag, []byte("link")) {
-								text_css = true
-							}
-							// <script type="text/javascript" src="....js" ExistOnlyLink
-						case bytes.Equal(attr, []byte("href")):
-							// <a href="..."> HtmlFilterLink
-							// <link rel="stylesheet" type="text/css" href="theme.css">
-							//   if type="text/css"  -> CssFilterLink
-							//   else -> ExistOnlyLink
-							if bytes.Equal(tag, []byte("a")) {
-								list = append(list, LinkContent{Url: string(val), Tag: strings.Join(locs, "/") + "/a(href)", Filter: HTMLFILTER})
-							} else if bytes.Equal(tag, []byte("link")) {
-								css = string(val)
-							}
-						case bytes.Equal(attr, []byte("src")):
-							// <iframe src="..."></iframe> HtmlFilterLink
-							// <img src="http://ih.com/b.png" ExistOnlyLink
-							// <script type="text/javascript" src="....js" ExistOnlyLink
-							if bytes.Equal(tag, []byte("iframe")) {
-								list = append(list, LinkContent{Url: string(val), Tag: strings.Join(locs, "/") + "/iframe", Filter: HTMLFILTER})
-							} else {
-								list = append(list, LinkContent{Url: string(val), Tag: strings.Join(locs, "/") + "/" + string(tag) + "(src)", Filter: EXISTFILTER})
-							}
-						case bytes.Equal(attr, []byte("srcset")):
-							// <img srcset="http://ih.com/b.png?... 960w, http://ih.com/b.png?... 480w"> ExistOnlyLink
-							if bytes.Equal(tag, []byte("img")) {
-								links := reSRCSET.FindAllStringSubmatch(string(val), -1)
-								for _, link := range links {
-									list = append(list, LinkContent{Url: link[1], Tag: strings.Join(locs, "/") + "/img(srcset)", Filter: EXISTFILTER})
-								}
-							}
-						case bytes.Equal(attr, []byte("action")):
-							// <form action="submit.htm" method="post"> Skip/Log only
-							if bytes.Equal(tag, []byte("form")) {
-								list = append(list, LinkContent{Url: string(val), Tag: strings.Join(locs, "/") + "/form", Filter: SKIPFILTER})
-							}
-						case bytes.Equal(attr, []byte("style")):
-							// a img form iframe ExistOnlyLink
-							links := parseCss(string(val))
-							for _, l := range links {
-								list = append(list, LinkContent{Url: l, Tag: strings.Join(locs, "/") + "/" + string(tag) + "(style)", Filter: EXISTFILTER})
-							}
-						}
-					}
-					if text_css && css != "" {
-						list = append(list, LinkContent{Url: css, Tag: strings.Join(locs, "/") + "/link", Filter: CSSFILTER})
-					} else if css != "" {
-						list = append(list, LinkContent{Url: css, Tag: strings.Join(locs, "/") + "/link", Filter: EXISTFILTER})
-					}
+		}
+		var css string
+		var text_css bool
+		for _, a := range n.Attr {
+			switch a.Key {
+			case "type":
+				// <link rel="stylesheet" type="text/css" href="theme.css">
+				//   if type="text/css"  -> CssFilterLink
+				//   else -> ExistOnlyLink
+				if n.Data == "link" {
+					text_css = true
 				}
-				if tokenType == html.StartTagToken {
-					if !bytes.Equal(tag, []byte("meta")) && !bytes.Equal(tag, []byte("link")) { // meta and link tags are NOT ALWAYS self closing
-						if id == "" && class == "" {
-							locs = append(locs, string(tag))
-						} else if id == "" {
-							locs = append(locs, string(tag)+"."+strings.TrimSpace(class))
-						} else if class == "" {
-							locs = append(locs, string(tag)+"#"+strings.TrimSpace(id))
-						} else {
-							locs = append(locs, string(tag)+"#"+strings.TrimSpace(id)+"."+strings.TrimSpace(class))
-						}
-					}
+				// <script type="text/javascript" src="....js" ExistOnlyLink
+			case "href":
+				// <a href="..."> HtmlFilterLink
+				// <link rel="stylesheet" type="text/css" href="theme.css">
+				//   if type="text/css"  -> CssFilterLink
+				//   else -> ExistOnlyLink
+				if n.Data == "a" {
+					list = append(list, LinkContent{Url: a.Val, Tag: loc + "/" + tag + "(href)", Filter: HTMLFILTER, Kind: n.Data + "(href)"})
+				} else if n.Data == "link" {
+					css = a.Val
 				}
-				for _, lc := range list {
-					li, err := ls.canon(ls.LinkInfo, lc.Url)
-					if err != nil {
-						ls.log.Info("req", "src", ls.String(), "tag", lc.Tag, "url", lc.Url, "initial", lc.Url, "err", err.Error(), "code", 0, "type", "", "net", false)
-					} else {
-						li.Tag = lc.Tag
-						switch lc.Filter {
-						case SKIPFILTER:
-							ls.log.Info("req", "src", ls.String(), "tag", lc.Tag, "url", li.String(), "initial", lc.Url, "err", "", "code", 0, "type", "SKIP", "net", false)
-						case EXISTFILTER:
-							procs = append(procs, ProcInfo(ExistOnlyLink{LinkInfo: li, source: ls.String(), Envs: ls.Envs}))
-						case HTMLFILTER:
-							procs = append(procs, ProcInfo(HtmlFilterLink{LinkInfo: li, source: ls.String(), Envs: ls.Envs}))
-						case CSSFILTER:
-							procs = append(procs, ProcInfo(CssFilterLink{LinkInfo: li, source: ls.String(), Envs: ls.Envs}))
-						}
-					}
+			case "src":
+				// <iframe src="..."></iframe> HtmlFilterLink
+				// <img src="http://ih.com/b.png" ExistOnlyLink
+				// <script type="text/javascript" src="....js" ExistOnlyLink
+				if n.Data == "iframe" {
+					list = append(list, LinkContent{Url: a.Val, Tag: loc + "/" + tag, Filter: HTMLFILTER, Mixed: ACTIVEMIXED, Kind: n.Data + "(src)"})
+				} else if n.Data == "script" || n.Data == "frame" || n.Data == "embed" {
+					list = append(list, LinkContent{Url: a.Val, Tag: loc + "/" + tag + "(src)", Filter: EXISTFILTER, Mixed: ACTIVEMIXED, Kind: n.Data + "(src)"})
+				} else {
+					list = append(list, LinkContent{Url: a.Val, Tag: loc + "/" + tag + "(src)", Filter: EXISTFILTER, Mixed: PASSIVEMIXED, Kind: n.Data + "(src)"})
 				}
-			case html.EndTagToken:
-				// pop element off the locs (tag#id.class) list
-				tag, _ := ls.htm.TagName()
-				if !bytes.Equal(tag, []byte("meta")) && !bytes.Equal(tag, []byte("link")) {
-					if len(locs) > 0 {
-						var tagstr = string(tag)
-						if strings.HasPrefix(locs[len(locs)-1], tagstr) {
-							locs = locs[:len(locs)-1]
-						} else {
-							var found bool
-							for len(locs) > 0 && (strings.HasPrefix(locs[len(locs)-1], "p") ||
-								strings.HasPrefix(locs[len(locs)-1], "br") ||
-								strings.HasPrefix(locs[len(locs)-1], "hr") ||
-								strings.HasPrefix(locs[len(locs)-1], "img") ||
-								strings.HasPrefix(locs[len(locs)-1], "input")) {
-								locs = locs[:len(locs)-1]
-								if strings.HasPrefix(locs[len(locs)-1], tagstr) {
-									locs = locs[:len(locs)-1]
-									found = true
-									break
-								}
-							}
-							if !found {
-								ls.log.Warn("parsing-error", "src", ls.String(), "tag", tagstr, "loc", strings.Join(locs, "/"))
-							}
-						}
+			case "srcset":
+				// <img srcset="http://ih.com/b.png?... 960w, http://ih.com/b.png?... 480w"> ExistOnlyLink
+				if n.Data == "img" {
+					links := reSRCSET.FindAllStringSubmatch(a.Val, -1)
+					for _, link := range links {
+						list = append(list, LinkContent{Url: link[1], Tag: loc + "/" + tag + "(srcset)", Filter: EXISTFILTER, Mixed: PASSIVEMIXED, Kind: n.Data + "(srcset)"})
 					}
 				}
+			case "action":
+				// <form action="submit.htm" method="post"> Skip/Log only
+				if n.Data == "form" {
+					list = append(list, LinkContent{Url: a.Val, Tag: loc + "/" + tag, Filter: SKIPFILTER, Kind: n.Data + "(action)"})
+				}
+			case "style":
+				// a img form iframe ExistOnlyLink
+				links := parseCss(a.Val)
+				for _, l := range links {
+					list = append(list, LinkContent{Url: l, Tag: loc + "/" + tag + "(style)", Filter: EXISTFILTER, Mixed: PASSIVEMIXED, Kind: n.Data + "(style)"})
+				}
+			}
+		}
+		rel := "link(" + linkRel(getAttr(n, "rel")) + ")"
+		if text_css && css != "" {
+			list = append(list, LinkContent{Url: css, Tag: loc + "/" + tag, Filter: CSSFILTER, Mixed: linkMixed(getAttr(n, "rel")), Kind: rel})
+		} else if css != "" {
+			list = append(list, LinkContent{Url: css, Tag: loc + "/" + tag, Filter: EXISTFILTER, Mixed: linkMixed(getAttr(n, "rel")), Kind: rel})
+		}
+		for _, lc := range list {
+			ls.MixedContent(lc)
+			li, err := ls.canon(ls.LinkInfo, lc.Url)
+			if err != nil {
+				ls.log.Info("req", "src", ls.String(), "tag", lc.Tag, "url", lc.Url, "initial", lc.Url, "err", err.Error(), "code", 0, "type", "", "net", false)
+			} else {
+				li.Tag = lc.Tag
+				li.Kind = lc.Kind
+				if lc.Mixed != NOTMIXED { // Subresources loaded with the page
+					ls.weights.Link(ls.String(), li.String())
+				}
+				switch lc.Filter {
+				case SKIPFILTER:
+					ls.log.Info("req", "src", ls.String(), "tag", lc.Tag, "url", li.String(), "initial", lc.Url, "err", "", "code", 0, "type", "SKIP", "net", false)
+				case EXISTFILTER:
+					procs = append(procs, ProcInfo(ExistOnlyLink{LinkInfo: li, source: ls.String(), Envs: ls.Envs, depth: ls.depth + 1}))
+				case HTMLFILTER:
+					procs = append(procs, ProcInfo(HtmlFilterLink{LinkInfo: li, source: ls.String(), Envs: ls.Envs, depth: ls.depth + 1}))
+				case CSSFILTER:
+					procs = append(procs, ProcInfo(CssFilterLink{LinkInfo: li, source: ls.String(), Envs: ls.Envs, depth: ls.depth + 1}))
+				}
 			}
 		}
+	})
+	return procs, nil
+}
+
+// walkHtml visits every element node of the parsed document
+// depth first, passing along the DOM path of its ancestors as
+// a list of tag#id.class location names, such as:
+//   html/body/div#abc.column_paragraph/div.gato-events
+func walkHtml(n *html.Node, locs []string, nth bool, fn func(*html.Node, []string)) {
+	if n.Type == html.ElementNode {
+		fn(n, locs)
+		locs = append(locs, locName(n, nth))
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		walkHtml(c, locs[:len(locs):len(locs)], nth, fn)
 	}
 }
 
+// locName returns the tag#id.class location name of an element,
+// optionally followed by its :nth-child(n) index so that
+// each location path is unique within the page.
+func locName(n *html.Node, nth bool) string {
+	name := n.Data
+	if id := strings.TrimSpace(getAttr(n, "id")); id != "" {
+		name += "#" + id
+	}
+	if class := strings.TrimSpace(getAttr(n, "class")); class != "" {
+		name += "." + class
+	}
+	if nth {
+		name += nthChild(n)
+	}
+	return name
+}
+
+// nthChild returns the CSS :nth-child(n) selector of an
+// element, counting only its element siblings.
+func nthChild(n *html.Node) string {
+	i := 1
+	for s := n.PrevSibling; s != nil; s = s.PrevSibling {
+		if s.Type == html.ElementNode {
+			i++
+		}
+	}
+	return fmt.Sprintf(":nth-child(%d)", i)
+}
+
+// hasAttr returns true if the element has the named attribute.
+func hasAttr(n *html.Node, key string) bool {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return true
+		}
+	}
+	return false
+}
+
+// getAttr returns the value of the named attribute
+// or an empty string if the element does not have it.
+func getAttr(n *html.Node, key string) string {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+// htmlTitle returns the trimmed text of
+// the document's first title element.
+func htmlTitle(root *html.Node) string {
+	var title string
+	var found bool
+	walkHtml(root, nil, false, func(n *html.Node, _ []string) {
+		if !found && n.Data == "title" {
+			title = strings.TrimSpace(textContent(n))
+			found = true
+		}
+	})
+	return title
+}
+
+// textContent returns the concatenated text of all
+// descendant text nodes of an element.
+func textContent(n *html.Node) string {
+	var buf bytes.Buffer
+	var text func(*html.Node)
+	text = func(n *html.Node) {
+		if n.Type == html.TextNode {
+			buf.WriteString(n.Data)
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			text(c)
+		}
+	}
+	text(n)
+	return buf.String()
+}
+
 // FilterCss may be used to scrape for links from CSS files matching url("...") patterns:
 //   a:hover
 //   {
 //     text-decoration:none;
 //     background: transparent url("http://gato-docs.its.txstate.edu/xiphophorus-genetic-stock-center/images/bg/logo-b.png") top center no-repeat fixed;
 //   }
-func (ls *Links) FilterCss(body io.Reader) ([]ProcInfo, error) {
+func (ls *Links) FilterCss(body []byte) ([]ProcInfo, error) {
 	var procs []ProcInfo
-	c, err := ioutil.ReadAll(body)
-	if err != nil {
-		return procs, err
-	}
-	links := parseCss(string(c))
+	ls.forbidden.Scan(ls.log, ls.source, ls.String(), body)
+	links := parseCss(string(body))
 	for _, link := range links {
+		ls.MixedContent(LinkContent{Url: link, Tag: "css/url", Filter: EXISTFILTER, Mixed: PASSIVEMIXED, Kind: "css/url"})
 		if li, err := ls.canon(ls.LinkInfo, link); err == nil {
 			li.Tag = "css/url"
-			procs = append(procs, ProcInfo(ExistOnlyLink{LinkInfo: li, source: ls.String(), Envs: ls.Envs}))
+			li.Kind = "css/url"
+			ls.weights.Link(ls.String(), li.String())
+			procs = append(procs, ProcInfo(ExistOnlyLink{LinkInfo: li, source: ls.String(), Envs: ls.Envs, depth: ls.depth + 1}))
 		} else {
 			ls.log.Info("req", "src", ls.String(), "tag", "css/url", "url", link, "err", err.Error(), "code", 0, "type", "", "net", false)
 		}
@@ -558,6 +905,105 @@ func (ls *Links) FilterCss(body io.Reader) ([]ProcInfo, error) {
 	return procs, nil
 }
 
+// Content-Type prefixes expected from existence checked
+// resources keyed on the kind of link, that is the tag and
+// attribute, that referenced them. Attribute only keys such
+// as "(style)" apply to any tag.
+var imageContent = []string{"image/"}
+var scriptContent = []string{"application/javascript", "application/x-javascript", "application/ecmascript", "text/javascript", "text/ecmascript"}
+var cssUrlContent = []string{"image/", "font/", "text/css", "application/font", "application/x-font", "application/vnd.ms-fontobject", "application/octet-stream"}
+var expectedContent = map[string][]string{
+	"img(src)":               imageContent,
+	"img(srcset)":            imageContent,
+	"input(src)":             imageContent,
+	"script(src)":            scriptContent,
+	"link(icon)":             imageContent,
+	"link(apple-touch-icon)": imageContent,
+	"link(stylesheet)":       []string{"text/css"},
+	"audio(src)":             []string{"audio/"},
+	"video(src)":             []string{"video/"},
+	"source(src)":            []string{"audio/", "video/", "image/"},
+	"track(src)":             []string{"text/vtt"},
+	"style":                  cssUrlContent,
+	"css/url":                cssUrlContent,
+	"(style)":                imageContent,
+}
+
+// CheckContentType returns an ErrUnexpectedContentType error
+// if the Content-Type header does not match one expected for
+// the kind of link, or an ErrMissingContentType error if there
+// is none. Kinds without expectations always pass.
+func CheckContentType(kind string, content string) error {
+	expect, ok := expectedContent[kind]
+	if !ok {
+		if i := strings.Index(kind, "("); i > 0 {
+			expect, ok = expectedContent[kind[i:]]
+		}
+		if !ok {
+			return nil
+		}
+	}
+	c := strings.ToLower(strings.TrimSpace(content))
+	if c == "" {
+		return ErrMissingContentType{kind: kind}
+	}
+	for _, e := range expect {
+		if strings.HasPrefix(c, e) {
+			return nil
+		}
+	}
+	return ErrUnexpectedContentType{kind: kind, content: content}
+}
+
+// linkRel reduces a link tag rel attribute to the single
+// relationship used to determine how it is processed; e.g.
+// rel="shortcut icon" is an icon.
+func linkRel(rel string) string {
+	rels := strings.Fields(strings.ToLower(rel))
+	for _, r := range rels {
+		if r == "stylesheet" || r == "icon" || r == "apple-touch-icon" {
+			return r
+		}
+	}
+	return strings.Join(rels, " ")
+}
+
+// Link rel values of subresources loaded with the page,
+// other than stylesheets; links such as canonical, alternate
+// or next only refer to other pages.
+var subresourceRels = map[string]bool{
+	"icon":             true,
+	"apple-touch-icon": true,
+	"preload":          true,
+	"prefetch":         true,
+	"manifest":         true,
+}
+
+// linkMixed returns the mixed content severity of a link tag
+// by its rel attribute; NOTMIXED unless it loads a subresource.
+func linkMixed(rel string) string {
+	mixed := NOTMIXED
+	for _, r := range strings.Fields(strings.ToLower(rel)) {
+		if r == "stylesheet" {
+			return ACTIVEMIXED
+		} else if subresourceRels[r] {
+			mixed = PASSIVEMIXED
+		}
+	}
+	return mixed
+}
+
+// MixedContent logs a mixed-content record for http:
+// subresources referenced from an https: page. The
+// link is checked as it was written in the page, before
+// canonicalization; so links later rewritten by a config
+// rule are still reported.
+func (ls *Links) MixedContent(lc LinkContent) {
+	if lc.Mixed != NOTMIXED && ls.Protocol == "https" && reHttpUrl.MatchString(strings.TrimSpace(lc.Url)) {
+		ls.log.Warn("mixed-content", "src", ls.String(), "tag", lc.Tag, "url", strings.TrimSpace(lc.Url), "severity", lc.Mixed)
+	}
+}
+
 // parseCSS may be used to scrape for links from style tags and attributes with CSS content for matching url("...") patterns:
 // <a
 //   href="/mjdf38i3tv0b56vz/xiphophorus-genetic-stock-center/about.html"
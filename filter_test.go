@@ -0,0 +1,238 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+
+	log "gopkg.in/inconshreveable/log15.v2"
+)
+
+// testLinks returns the Links of a page being filtered,
+// with a discarded log and a canonicalizer allowing any
+// domain.
+func testLinks(t testing.TB, page string) *Links {
+	canon, err := NewCanonicalize(Config{base: regexp.MustCompile(`.`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	li, err := canon(LinkInfo{}, page)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Links{LinkInfo: li, Envs: Envs{canon: canon, crawl: true}, log: discardLog()}
+}
+
+func discardLog() log.Logger {
+	l := log.New()
+	l.SetHandler(log.DiscardHandler())
+	return l
+}
+
+// testEnvs returns the Envs of a crawl of the urls matching
+// base, with the same defaults as the command line.
+func testEnvs(t testing.TB, base string) Envs {
+	canon, err := NewCanonicalize(Config{base: regexp.MustCompile(base)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	heads, err := NewHeads("403,405,501")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bodies, err := NewBodies(false, "text/html=20M,text/css=5M,*=10M")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewVisitedStore("map")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Envs{visited: NewVisited(store), canon: canon, crawl: true, dupes: NewDuplicates(), timings: NewTimings(0, 0), certs: NewCerts(30), heads: heads, bodies: bodies}
+}
+
+// testLog is a logger keeping the context of every entry,
+// by key, along with its message.
+type testLog struct {
+	mu      sync.Mutex
+	entries []log.Ctx
+}
+
+func (tl *testLog) logger() log.Logger {
+	l := log.New()
+	l.SetHandler(log.FuncHandler(func(r *log.Record) error {
+		ctx := log.Ctx{"msg": r.Msg}
+		for i := 0; i+1 < len(r.Ctx); i += 2 {
+			ctx[r.Ctx[i].(string)] = r.Ctx[i+1]
+		}
+		tl.mu.Lock()
+		tl.entries = append(tl.entries, ctx)
+		tl.mu.Unlock()
+		return nil
+	}))
+	return l
+}
+
+// find returns the entries logged with a message.
+func (tl *testLog) find(msg string) []log.Ctx {
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+	var found []log.Ctx
+	for _, ctx := range tl.entries {
+		if ctx["msg"] == msg {
+			found = append(found, ctx)
+		}
+	}
+	return found
+}
+
+// testCrawl crawls from the seed urls and returns its log.
+func testCrawl(envs Envs, threads int, seeds ...string) *testLog {
+	tl := &testLog{}
+	Run(tl.logger(), threads, Frontier{}, StartHtmlFilterLinks(envs, seeds))
+	return tl
+}
+
+// procLine describes a ProcInfo as its filter, tag and url.
+func procLine(pi ProcInfo) string {
+	switch link := pi.(type) {
+	case HtmlFilterLink:
+		return "html\t" + link.Tag + "\t" + link.String()
+	case CssFilterLink:
+		return "css\t" + link.Tag + "\t" + link.String()
+	case ExistOnlyLink:
+		return "exist\t" + link.Tag + "\t" + link.String()
+	}
+	return "?\t\t" + pi.String()
+}
+
+// The links extracted from the fixture page, in document order,
+// are listed in testdata/links.txt.
+func TestFilterHtmlLinks(t *testing.T) {
+	body, err := ioutil.ReadFile("testdata/links.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := ioutil.ReadFile("testdata/links.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pis, err := testLinks(t, "https://www.txstate.edu/").FilterHtml(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, pi := range pis {
+		got = append(got, procLine(pi))
+	}
+	wants := strings.Split(strings.TrimSpace(string(want)), "\n")
+	if strings.Join(got, "\n") != strings.Join(wants, "\n") {
+		t.Errorf("links:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(wants, "\n"))
+	}
+}
+
+// Only subresources loaded with an https page are reported as
+// mixed content; not links to other pages such as canonicals.
+func TestMixedContentRels(t *testing.T) {
+	body, err := ioutil.ReadFile("testdata/links.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ls := testLinks(t, "https://www.txstate.edu/")
+	var got []string
+	ls.log.SetHandler(log.FuncHandler(func(r *log.Record) error {
+		if r.Msg == "mixed-content" {
+			ctx := log.Ctx{}
+			for i := 0; i+1 < len(r.Ctx); i += 2 {
+				ctx[r.Ctx[i].(string)] = r.Ctx[i+1]
+			}
+			got = append(got, ctx["severity"].(string)+"\t"+ctx["url"].(string))
+		}
+		return nil
+	}))
+	if _, err := ls.FilterHtml(body); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"passive\thttp://www.txstate.edu/favicon.ico",
+		"passive\thttp://www.txstate.edu/fonts/body.woff2",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("mixed content:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestCheckContentType(t *testing.T) {
+	tests := []struct {
+		kind    string
+		content string
+		err     error
+	}{
+		{"img(src)", "image/png", nil},
+		{"img(src)", "text/html;charset=UTF-8", ErrUnexpectedContentType{kind: "img(src)", content: "text/html;charset=UTF-8"}},
+		{"img(src)", "", ErrMissingContentType{kind: "img(src)"}},
+		{"script(src)", "  ", ErrMissingContentType{kind: "script(src)"}},
+		{"link(stylesheet)", "Text/CSS", nil},
+		{"div(style)", "image/gif", nil},
+		{"a(href)", "application/pdf", nil},
+		{"a(href)", "", nil},
+	}
+	for _, test := range tests {
+		if err := CheckContentType(test.kind, test.content); err != test.err {
+			t.Errorf("CheckContentType(%q, %q) = %v, want %v", test.kind, test.content, err, test.err)
+		}
+	}
+}
+
+// Only html and css responses are read. Other content linked
+// from a tags is closed unread, while stylesheets served with
+// another Content-Type are reported yet still parsed.
+func TestRequestContentType(t *testing.T) {
+	written := make(chan int64, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			w.Header().Set("Content-Type", "text/html")
+			fmt.Fprint(w, `<html><head><link rel="stylesheet" type="text/css" href="/theme.css"></head><body><a href="/download">Report</a></body></html>`)
+		case "/theme.css":
+			w.Header().Set("Content-Type", "text/plain")
+			fmt.Fprint(w, `body { background: url("/bg.png"); }`)
+		case "/bg.png":
+			w.Header().Set("Content-Type", "image/png")
+		case "/download":
+			w.Header().Set("Content-Type", "application/pdf")
+			chunk := make([]byte, 64*1024)
+			var n int64
+			for n < 64<<20 {
+				if _, err := w.Write(chunk); err != nil {
+					break
+				}
+				n += int64(len(chunk))
+			}
+			written <- n
+		}
+	}))
+	defer ts.Close()
+	tl := testCrawl(testEnvs(t, "^"+regexp.QuoteMeta(ts.URL)+"($|/)"), 1, ts.URL+"/")
+	errs := make(map[string]interface{})
+	for _, ctx := range tl.find("req") {
+		errs[ctx["url"].(string)] = ctx["err"]
+	}
+	if err := errs[ts.URL+"/theme.css"]; err != (ErrUnexpectedContentType{kind: "link(stylesheet)", content: "text/plain"}).Error() {
+		t.Errorf("stylesheet err %q", err)
+	}
+	if err, ok := errs[ts.URL+"/bg.png"]; !ok || err != "" {
+		t.Errorf("stylesheet url() not checked: %q, %v", err, ok)
+	}
+	if err := errs[ts.URL+"/download"]; err != (ErrNotHtmlContent{content: "application/pdf"}).Error() {
+		t.Errorf("download err %q", err)
+	}
+	if n := <-written; n >= 64<<20 {
+		t.Errorf("download read whole; %d bytes written", n)
+	}
+}
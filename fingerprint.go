@@ -0,0 +1,45 @@
+// Content fingerprinting (fingerprint)
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"regexp"
+	"strings"
+)
+
+var reWhitespace = regexp.MustCompile(`\s+`)
+
+// Volatiles is the list of regular expressions matching
+// regions of a page that change between requests without
+// the page itself changing; such as cache busting hashes
+// and timestamps. They are declared one per line in the
+// [volatile] section of the config file:
+//   /cache[0-9a-z]+/
+//   [0-9]{4}-[0-9]{2}-[0-9]{2}T[0-9:.]+
+type Volatiles []*regexp.Regexp
+
+func (vs *Volatiles) Parse(fields []string) error {
+	if len(fields) != 1 {
+		return ErrConfigFile{line: strings.Join(fields, "\t")}
+	}
+	re, err := regexp.Compile(fields[0])
+	if err != nil {
+		return err
+	}
+	*vs = append(*vs, re)
+	return nil
+}
+
+// Hash returns the hex encoded sha1 hash of a page body
+// after removing volatile regions and collapsing runs of
+// whitespace; so that only meaningful content changes
+// result in a different hash.
+func (vs Volatiles) Hash(body []byte) string {
+	for _, re := range vs {
+		body = re.ReplaceAll(body, nil)
+	}
+	body = reWhitespace.ReplaceAll(body, []byte(" "))
+	h := sha1.Sum(body)
+	return hex.EncodeToString(h[:])
+}
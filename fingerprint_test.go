@@ -0,0 +1,27 @@
+package main
+
+import "testing"
+
+func TestVolatilesHash(t *testing.T) {
+	var vs Volatiles
+	for _, re := range []string{`/cache[0-9a-z]+/`, `[0-9]{4}-[0-9]{2}-[0-9]{2}T[0-9:.]+`} {
+		if err := vs.Parse([]string{re}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	page := `<img src="/cache32f7a6755fe8/logo.png"> <p>Updated 2016-05-01T10:00:00</p>`
+	same := "<img src=\"/cache0a1b2c/logo.png\">\n\n  <p>Updated\t2016-06-12T08:30:15.5</p>"
+	changed := `<img src="/cache32f7a6755fe8/logo.png"> <p>Revised 2016-05-01T10:00:00</p>`
+	if vs.Hash([]byte(page)) != vs.Hash([]byte(same)) {
+		t.Error("volatile regions or whitespace changed the hash")
+	}
+	if vs.Hash([]byte(page)) == vs.Hash([]byte(changed)) {
+		t.Error("content change kept the hash")
+	}
+	if h := Volatiles(nil).Hash([]byte(page)); h == vs.Hash([]byte(page)) || len(h) != 40 {
+		t.Errorf("hash without volatile regions %q", h)
+	}
+	if err := vs.Parse([]string{"a", "b"}); err == nil {
+		t.Error("Parse accepted two fields")
+	}
+}
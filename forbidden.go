@@ -0,0 +1,64 @@
+// Forbidden pattern scanning of response bodies (forbidden)
+package main
+
+import (
+	"bytes"
+	log "gopkg.in/inconshreveable/log15.v2"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// Longest matched snippet included in a forbidden log entry.
+const forbiddenSnippet = 160
+
+type Forbidden struct {
+	name string
+	re   *regexp.Regexp
+}
+
+// Forbiddens is the list of named regular expressions that
+// must never match the raw body of html and css responses.
+// They are declared in the [forbidden] section of the
+// config file as tab delimited name and regexp entries:
+//   author-path	/mjdf38i3tv0b56vz/
+//   localhost	localhost:8080
+type Forbiddens []Forbidden
+
+func (fs *Forbiddens) Parse(fields []string) error {
+	if len(fields) != 2 || fields[0] == "" {
+		return ErrConfigFile{line: strings.Join(fields, "\t")}
+	}
+	re, err := regexp.Compile(fields[1])
+	if err != nil {
+		return err
+	}
+	*fs = append(*fs, Forbidden{name: fields[0], re: re})
+	return nil
+}
+
+// Scan logs a forbidden entry for every match of every rule
+// in body, along with the line number the match starts on.
+func (fs Forbiddens) Scan(l log.Logger, src string, url string, body []byte) {
+	for _, f := range fs {
+		line, pos := 1, 0
+		for _, m := range f.re.FindAllIndex(body, -1) {
+			line += bytes.Count(body[pos:m[0]], []byte("\n"))
+			pos = m[0]
+			snippet := truncateRunes(string(body[m[0]:m[1]]), forbiddenSnippet)
+			l.Warn("forbidden", "src", src, "url", url, "line", line, "match", snippet, "rule", f.name)
+		}
+	}
+}
+
+// truncateRunes truncates s to at most n bytes without
+// splitting a multi-byte UTF-8 rune.
+func truncateRunes(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
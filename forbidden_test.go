@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestTruncateRunes(t *testing.T) {
+	tests := []struct {
+		s    string
+		n    int
+		want string
+	}{
+		{"abc", 5, "abc"},
+		{"abcdef", 3, "abc"},
+		{"añb", 2, "a"},
+		{"añb", 3, "añ"},
+		{"€uro", 1, ""},
+		{"€uro", 2, ""},
+		{"€uro", 3, "€"},
+	}
+	for _, test := range tests {
+		if got := truncateRunes(test.s, test.n); got != test.want {
+			t.Errorf("truncateRunes(%q, %d) = %q, want %q", test.s, test.n, got, test.want)
+		}
+	}
+	long := strings.Repeat("ü", forbiddenSnippet)
+	if got := truncateRunes(long, forbiddenSnippet-1); !utf8.ValidString(got) {
+		t.Errorf("truncateRunes split a rune: %q", got)
+	}
+}
+
+// Every match of every rule is logged with the line it
+// starts on.
+func TestForbiddenScan(t *testing.T) {
+	var fs Forbiddens
+	for _, fields := range [][]string{{"author-path", "/mjdf38i3tv0b56vz/"}, {"localhost", `localhost:\d+`}} {
+		if err := fs.Parse(fields); err != nil {
+			t.Fatal(err)
+		}
+	}
+	body := "<html>\n<a href=\"/mjdf38i3tv0b56vz/about.html\">\n<img src=\"http://localhost:8080/a.png\">\n\n<a href=\"/mjdf38i3tv0b56vz/news\">\n</html>"
+	tl := &testLog{}
+	fs.Scan(tl.logger(), "https://www.txstate.edu/", "https://www.txstate.edu/page", []byte(body))
+	var got []string
+	for _, ctx := range tl.find("forbidden") {
+		got = append(got, fmt.Sprintf("%v %v %v", ctx["rule"], ctx["line"], ctx["match"]))
+	}
+	want := []string{
+		"author-path 2 /mjdf38i3tv0b56vz/",
+		"author-path 5 /mjdf38i3tv0b56vz/",
+		"localhost 3 localhost:8080",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("forbidden entries:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	for _, fields := range [][]string{{"", "x"}, {"name"}, {"name", "(unclosed"}} {
+		if err := fs.Parse(fields); err == nil {
+			t.Errorf("Parse(%q) accepted", fields)
+		}
+	}
+}
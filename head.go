@@ -0,0 +1,63 @@
+// HEAD request fallback (head)
+package main
+
+import (
+	log "gopkg.in/inconshreveable/log15.v2"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Heads tracks the hosts whose HEAD responses are unreliable;
+// i.e. hosts that rejected a HEAD request with one of the
+// fallback status codes but answered the same url's GET
+// request successfully. Existence checks of such hosts are
+// made with ranged GET requests instead. It is shared by
+// all threads.
+type Heads struct {
+	mu       sync.Mutex
+	fallback map[int]bool
+	hosts    map[string]bool
+}
+
+// NewHeads returns Heads that fall back to a GET request when
+// a HEAD request is answered with one of the comma delimited
+// status codes; e.g. "403,405,501".
+func NewHeads(statuses string) (*Heads, error) {
+	h := &Heads{fallback: make(map[int]bool), hosts: make(map[string]bool)}
+	for _, s := range strings.Split(statuses, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			code, err := strconv.Atoi(s)
+			if err != nil {
+				return nil, err
+			}
+			h.fallback[code] = true
+		}
+	}
+	return h, nil
+}
+
+// Fallback returns true if a HEAD response
+// status should be retried with a GET request.
+func (h *Heads) Fallback(status int) bool {
+	return h.fallback[status]
+}
+
+// Unreliable returns true if the host's
+// HEAD responses are known to be unreliable.
+func (h *Heads) Unreliable(host string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.hosts[host]
+}
+
+// MarkUnreliable remembers the host's HEAD responses are
+// unreliable, logging a head-unreliable entry the first time.
+func (h *Heads) MarkUnreliable(l log.Logger, host string, url string, status int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.hosts[host] {
+		h.hosts[host] = true
+		l.Warn("head-unreliable", "host", host, "url", url, "code", status)
+	}
+}
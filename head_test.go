@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sync"
+	"testing"
+)
+
+func TestNewHeads(t *testing.T) {
+	h, err := NewHeads(" 403, 405,,501")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for status, want := range map[int]bool{403: true, 405: true, 501: true, 200: false, 404: false} {
+		if h.Fallback(status) != want {
+			t.Errorf("Fallback(%d) = %t, want %t", status, !want, want)
+		}
+	}
+	if h, err = NewHeads(""); err != nil || h.Fallback(405) {
+		t.Errorf("empty status codes fall back, %v", err)
+	}
+	if _, err = NewHeads("405,50x"); err == nil {
+		t.Errorf("invalid status code accepted")
+	}
+}
+
+// A host is only reported as unreliable once.
+func TestHeadsMarkUnreliable(t *testing.T) {
+	h, err := NewHeads("405")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Unreliable("www.txstate.edu") {
+		t.Errorf("host unreliable before being marked")
+	}
+	tl := &testLog{}
+	h.MarkUnreliable(tl.logger(), "www.txstate.edu", "https://www.txstate.edu/a.png", 405)
+	h.MarkUnreliable(tl.logger(), "www.txstate.edu", "https://www.txstate.edu/b.png", 403)
+	if !h.Unreliable("www.txstate.edu") || h.Unreliable("gato.txstate.edu") {
+		t.Errorf("only www.txstate.edu should be unreliable")
+	}
+	if entries := tl.find("head-unreliable"); len(entries) != 1 || entries[0]["url"] != "https://www.txstate.edu/a.png" || entries[0]["code"] != 405 {
+		t.Errorf("head-unreliable entries %v, want one for a.png", entries)
+	}
+}
+
+// headSite serves images that reject HEAD requests with a 405,
+// answering ranged GET requests with their first byte.
+type headSite struct {
+	mu    sync.Mutex
+	heads int
+}
+
+func (hs *headSite) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/":
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, `<html><body><img src="/a.png"><img src="/b.png"><img src="/gone.png"></body></html>`)
+		return
+	case "/gone.png":
+		if r.Method == "GET" {
+			http.NotFound(w, r)
+			return
+		}
+	}
+	if r.Method == "HEAD" {
+		hs.mu.Lock()
+		hs.heads++
+		hs.mu.Unlock()
+		w.WriteHeader(405)
+		return
+	}
+	if r.Header.Get("Range") != "bytes=0-0" {
+		w.WriteHeader(400)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Content-Range", "bytes 0-0/1234")
+	w.WriteHeader(206)
+	w.Write([]byte{0x89})
+}
+
+// Existence checks rejected with a HEAD fallback status are
+// retried with a ranged GET; once a GET succeeds, the host's
+// existence checks are all made with GET requests.
+func TestHeadFallback(t *testing.T) {
+	hs := &headSite{}
+	ts := httptest.NewServer(hs)
+	defer ts.Close()
+	envs := testEnvs(t, regexp.QuoteMeta(ts.URL))
+	tl := testCrawl(envs, 2, ts.URL+"/")
+	want := map[string]int{ts.URL + "/a.png": 200, ts.URL + "/b.png": 200, ts.URL + "/gone.png": 404}
+	for _, ctx := range tl.find("req") {
+		url := ctx["url"].(string)
+		code, ok := want[url]
+		if !ok {
+			continue
+		}
+		if ctx["code"] != code || ctx["type"] != "GET" {
+			t.Errorf("%s: code %v type %v, want %d GET", url, ctx["code"], ctx["type"], code)
+		}
+		if head, ok := ctx["head"]; ok && head != 405 {
+			t.Errorf("%s: head %v, want 405", url, head)
+		}
+		delete(want, url)
+	}
+	if len(want) != 0 {
+		t.Errorf("no req entries for %v", want)
+	}
+	unreliable := tl.find("head-unreliable")
+	if len(unreliable) != 1 {
+		t.Fatalf("head-unreliable entries %v, want 1", unreliable)
+	}
+	if host := unreliable[0]["host"].(string); !envs.heads.Unreliable(host) {
+		t.Errorf("%s not remembered as unreliable", host)
+	}
+
+	// A further crawl makes no HEAD requests of the host.
+	hs.heads = 0
+	tl = testCrawl(envs, 2, ts.URL+"/")
+	if hs.heads != 0 {
+		t.Errorf("%d HEAD requests made of an unreliable host", hs.heads)
+	}
+	for _, ctx := range tl.find("req") {
+		if _, ok := ctx["head"]; ok {
+			t.Errorf("%v: HEAD request retried for an unreliable host", ctx["url"])
+		}
+	}
+}
+
+// Hosts whose GET requests fail are not marked unreliable.
+func TestHeadFallbackGone(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/" {
+			w.Header().Set("Content-Type", "text/html")
+			fmt.Fprint(w, `<html><body><img src="/gone.png"></body></html>`)
+		} else if r.Method == "HEAD" {
+			w.WriteHeader(405)
+		} else {
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+	envs := testEnvs(t, regexp.QuoteMeta(ts.URL))
+	tl := testCrawl(envs, 1, ts.URL+"/")
+	if entries := tl.find("head-unreliable"); len(entries) != 0 {
+		t.Errorf("head-unreliable entries %v, want none", entries)
+	}
+	for _, ctx := range tl.find("req") {
+		if ctx["url"] == ts.URL+"/gone.png" && (ctx["code"] != 404 || ctx["head"] != 405) {
+			t.Errorf("gone.png: code %v head %v, want 404 and 405", ctx["code"], ctx["head"])
+		}
+	}
+}
+
+func TestContentRangeLength(t *testing.T) {
+	for cr, want := range map[string]int64{"bytes 0-0/1234": 1234, "bytes 0-0/*": -1, "": -1} {
+		if got := contentRangeLength(cr); got != want {
+			t.Errorf("contentRangeLength(%q) = %d, want %d", cr, got, want)
+		}
+	}
+}
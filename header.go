@@ -0,0 +1,133 @@
+// Scoped request headers and header profiles (header)
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// Header is a request header added to requests of urls matching
+// its regexp, made while crawling from seeds selecting its
+// profile. Headers without a regexp match all urls, and those
+// without a profile are added whatever the seed's profile.
+// Values may contain the following templates:
+//   {{id}}	unique id of the request, also logged as reqid
+//   {{url}}	url being requested
+//   {{src}}	url of the page the link was found on
+//   {{profile}}	header profile of the seed
+type Header struct {
+	Name    string
+	Val     string
+	profile string
+	url     *regexp.Regexp
+}
+
+// Headers are the request headers of the run. Besides the
+// +header= arguments, which apply to all requests, they are
+// declared in the [header] section of the config file or in a
+// --headers file as tab delimited profile, url regexp and
+// header entries; where a profile or url of * matches all:
+//   *	^https?://gato-staging-[^/]+\.its\.txstate\.edu/	Via: Proxy-HistoryCache/1.8.5
+//   *	.	X-Request-Id: thrawler-{{id}}
+//   editor	^http://localhost:8080/	X-Referer: {{src}}
+type Headers []Header
+
+func (hs *Headers) Parse(fields []string) error {
+	if len(fields) != 3 || fields[0] == "" || fields[1] == "" {
+		return ErrConfigFile{line: strings.Join(fields, "\t")}
+	}
+	nv := strings.SplitN(fields[2], ":", 2)
+	if len(nv) != 2 || strings.TrimSpace(nv[0]) == "" {
+		return ErrConfigFile{line: strings.Join(fields, "\t")}
+	}
+	h := Header{Name: strings.TrimSpace(nv[0]), Val: strings.TrimSpace(nv[1])}
+	if fields[0] != "*" {
+		h.profile = fields[0]
+	}
+	if fields[1] != "*" {
+		re, err := regexp.Compile(fields[1])
+		if err != nil {
+			return err
+		}
+		h.url = re
+	}
+	*hs = append(*hs, h)
+	return nil
+}
+
+// Load parses a --headers file of [header] entries;
+// blank lines and # comments are skipped.
+func (hs *Headers) Load(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := hs.Parse(strings.Split(line, "\t")); err != nil {
+			if _, ok := err.(ErrConfigFile); ok {
+				return err
+			}
+			return ErrConfigFile{line: line, err: err}
+		}
+	}
+	return scanner.Err()
+}
+
+// Profile returns true if a header belongs to the profile.
+func (hs Headers) Profile(profile string) bool {
+	for _, h := range hs {
+		if h.profile == profile {
+			return true
+		}
+	}
+	return false
+}
+
+// Prefix of the request ids of the run; so that ids
+// are unique across runs as well as within a run.
+var reqRun = func() string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}()
+var reqCount int64
+
+// Add adds the headers matching the request's url and profile,
+// expanding their templates. It returns the request's id if
+// any of the added headers use one; otherwise "".
+func (hs Headers) Add(req *http.Request, profile string, src string) string {
+	var id string
+	url := req.URL.String()
+	for _, h := range hs {
+		if (h.profile != "" && h.profile != profile) || (h.url != nil && !h.url.MatchString(url)) {
+			continue
+		}
+		val := h.Val
+		if strings.Contains(val, "{{") {
+			if id == "" && strings.Contains(val, "{{id}}") {
+				id = reqRun + "-" + strconv.FormatInt(atomic.AddInt64(&reqCount, 1), 10)
+			}
+			val = strings.NewReplacer("{{id}}", id, "{{url}}", url, "{{src}}", src, "{{profile}}", profile).Replace(val)
+		}
+		req.Header.Add(h.Name, val)
+	}
+	return id
+}
+
+// splitSeed splits a seed url from the name of the
+// header profile it selects; e.g. "<url>\teditor".
+func splitSeed(seed string) (string, string) {
+	up := strings.SplitN(seed, "\t", 2)
+	if len(up) == 2 {
+		return strings.TrimSpace(up[0]), strings.TrimSpace(up[1])
+	}
+	return seed, ""
+}
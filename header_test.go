@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestHeadersParse(t *testing.T) {
+	for _, test := range []struct {
+		line    string
+		name    string
+		val     string
+		profile string
+		url     string
+		err     bool
+	}{
+		{"*\t*\tVia: Proxy-HistoryCache/1.8.5", "Via", "Proxy-HistoryCache/1.8.5", "", "", false},
+		{"editor\t^http://localhost:8080/\tX-Referer: {{src}}", "X-Referer", "{{src}}", "editor", "^http://localhost:8080/", false},
+		{"*\t.\tX-Time: 12:30", "X-Time", "12:30", "", ".", false},
+		{"*\t*\tVia", "", "", "", "", true},
+		{"*\t*\t: value", "", "", "", "", true},
+		{"*\t(\tVia: proxy", "", "", "", "", true},
+		{"\t*\tVia: proxy", "", "", "", "", true},
+		{"*\tVia: proxy", "", "", "", "", true},
+	} {
+		var hs Headers
+		err := hs.Parse(strings.Split(test.line, "\t"))
+		if (err != nil) != test.err {
+			t.Errorf("%q: error %v, want error %t", test.line, err, test.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		h := hs[0]
+		var url string
+		if h.url != nil {
+			url = h.url.String()
+		}
+		if h.Name != test.name || h.Val != test.val || h.profile != test.profile || url != test.url {
+			t.Errorf("%q: parsed %q %q profile %q url %q", test.line, h.Name, h.Val, h.profile, url)
+		}
+	}
+}
+
+// Errors of a --headers file entry keep their underlying message.
+func TestHeadersLoad(t *testing.T) {
+	var hs Headers
+	file := "# proxy headers\n\n*\t*\tVia: proxy\neditor\t.\tX-Editor: yes\n"
+	if err := hs.Load(strings.NewReader(file)); err != nil || len(hs) != 2 {
+		t.Errorf("loaded %v, %v; want 2 headers", hs, err)
+	}
+	for bad, want := range map[string]string{
+		"*\t(\tVia: proxy": "Config file issue with following line '*\t(\tVia: proxy': error parsing regexp",
+		"*\t*\tVia":        "Config file issue with following line '*\t*\tVia'",
+	} {
+		err := hs.Load(strings.NewReader(bad + "\n"))
+		if err == nil || !strings.HasPrefix(err.Error(), want) || strings.Count(err.Error(), "Config file issue") != 1 {
+			t.Errorf("%q: error %v, want %q", bad, err, want)
+		}
+	}
+}
+
+// +header= arguments are added to all requests.
+func TestHeaderArgs(t *testing.T) {
+	hs := headerArgs([]string{"+header=Via: proxy", "+header=X-Empty:", "+header=nocolon", "header=X-No: plus", "+header=X-Time: 12:30"})
+	req, err := http.NewRequest("GET", "https://www.txstate.edu/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs.Add(req, "editor", "")
+	if len(req.Header) != 2 || req.Header.Get("Via") != "proxy" || req.Header.Get("X-Time") != "12:30" {
+		t.Errorf("headers %v, want Via and X-Time", req.Header)
+	}
+}
+
+// Headers are added to requests of their url and profile,
+// with templates expanded.
+func TestHeadersAdd(t *testing.T) {
+	var hs Headers
+	for _, line := range []string{
+		"*\t*\tVia: proxy",
+		"*\t^https://gato\\.\tX-Gato: yes",
+		"editor\t*\tX-Profile: {{profile}}",
+		"*\t*\tX-Request: {{id}} {{url}} {{src}}",
+		"*\t*\tX-Again: {{id}}",
+	} {
+		if err := hs.Parse(strings.Split(line, "\t")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	add := func(url string, profile string) (*http.Request, string) {
+		req, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return req, hs.Add(req, profile, "https://www.txstate.edu/")
+	}
+	req, id := add("https://gato.txstate.edu/a", "editor")
+	if req.Header.Get("Via") != "proxy" || req.Header.Get("X-Gato") != "yes" || req.Header.Get("X-Profile") != "editor" {
+		t.Errorf("gato editor headers %v", req.Header)
+	}
+	if id == "" || req.Header.Get("X-Request") != id+" https://gato.txstate.edu/a https://www.txstate.edu/" || req.Header.Get("X-Again") != id {
+		t.Errorf("id %q, templated headers %v", id, req.Header)
+	}
+	req, other := add("https://www.txstate.edu/b", "")
+	if req.Header.Get("X-Gato") != "" || req.Header.Get("X-Profile") != "" {
+		t.Errorf("out of scope headers added: %v", req.Header)
+	}
+	if other == "" || other == id {
+		t.Errorf("request ids %q and %q, want distinct ids", id, other)
+	}
+	if id := hs[:3].Add(req, "", ""); id != "" {
+		t.Errorf("id %q without an {{id}} template", id)
+	}
+}
+
+// Links found crawling from a seed carry the headers of the
+// seed's profile, and request ids are logged with their req.
+func TestHeaderProfilesCrawl(t *testing.T) {
+	var mu sync.Mutex
+	got := make(map[string]http.Header)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		got[r.URL.Path] = r.Header
+		mu.Unlock()
+		w.Header().Set("Content-Type", "text/html")
+		switch r.URL.Path {
+		case "/editor":
+			fmt.Fprint(w, `<html><body><a href="/edited">edited</a></body></html>`)
+		case "/public":
+			fmt.Fprint(w, `<html><body><a href="/viewed">viewed</a></body></html>`)
+		}
+	}))
+	defer ts.Close()
+	envs := testEnvs(t, regexp.QuoteMeta(ts.URL))
+	for _, line := range []string{"editor\t*\tX-Profile: {{profile}}", "*\t*\tX-Request-Id: thrawler-{{id}}"} {
+		if err := envs.headers.Parse(strings.Split(line, "\t")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tl := testCrawl(envs, 2, ts.URL+"/editor\teditor", ts.URL+"/public")
+	for path, profile := range map[string]string{"/editor": "editor", "/edited": "editor", "/public": "", "/viewed": ""} {
+		if h := got[path]; h == nil || h.Get("X-Profile") != profile {
+			t.Errorf("%s: X-Profile %q, want %q", path, h.Get("X-Profile"), profile)
+		}
+	}
+	reqs := tl.find("req")
+	for _, ctx := range reqs {
+		path := strings.TrimPrefix(ctx["url"].(string), ts.URL)
+		if want := "thrawler-" + fmt.Sprint(ctx["reqid"]); got[path].Get("X-Request-Id") != want {
+			t.Errorf("%s: X-Request-Id %q, want %q", path, got[path].Get("X-Request-Id"), want)
+		}
+	}
+	if len(reqs) != 4 {
+		t.Errorf("%d req entries, want 4", len(reqs))
+	}
+}
@@ -2,9 +2,11 @@
 package main
 
 import (
+	"container/heap"
 	log "gopkg.in/inconshreveable/log15.v2"
-	"hash/fnv"
+	"sort"
 	"sync"
+	"time"
 )
 
 type ProcInfo interface {
@@ -12,61 +14,290 @@ type ProcInfo interface {
 	Fn(log.Logger, int) []ProcInfo
 }
 
-type proc chan ProcInfo
+// DelayedProc wraps a ProcInfo that should only be
+// queued after a delay; such as a retried request. The
+// delay is waited out by a timer rather than a listener.
+type DelayedProc struct {
+	ProcInfo
+	Delay time.Duration
+}
+
+// Prioritized ProcInfo are processed in order of their
+// priority, lowest first; ProcInfo of equal priority, and
+// those without one, are processed in the order queued.
+type Prioritized interface {
+	Priority() int
+}
+
+type queued struct {
+	pi       ProcInfo
+	priority int
+	seq      int64
+}
+
+// procQueue is the in-memory queue of ProcInfo, ordered
+// as a heap by priority and then by queue order.
+type procQueue []queued
+
+func (q procQueue) Len() int { return len(q) }
+func (q procQueue) Less(i, j int) bool {
+	if q[i].priority != q[j].priority {
+		return q[i].priority < q[j].priority
+	}
+	return q[i].seq < q[j].seq
+}
+func (q procQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *procQueue) Push(x interface{}) { *q = append(*q, x.(queued)) }
+func (q *procQueue) Pop() interface{} {
+	old := *q
+	x := old[len(old)-1]
+	old[len(old)-1] = queued{}
+	*q = old[:len(old)-1]
+	return x
+}
 
+// Spiller encodes ProcInfo so that they may be
+// spilled to disk, and decodes them once read back.
+type Spiller interface {
+	Encode(ProcInfo) ([]byte, error)
+	Decode([]byte) (ProcInfo, error)
+}
+
+// Frontier bounds the number of ProcInfo queued in memory.
+// Once Max are queued, further ProcInfo are spilled to
+// temporary files in Dir, encoded by the Spiller; so memory
+// use stays flat regardless of the size of the site. A Max
+// of zero, or no Spiller, leaves the frontier unbounded. The
+// frontier's size is logged as progress every Progress.
+// Delayed ProcInfo, such as retried requests, are always
+// kept in memory; they may hold claims other ProcInfo wait
+// on, which a spilled record that fails to read would never
+// release.
+type Frontier struct {
+	Max      int
+	Dir      string
+	Spiller  Spiller
+	Progress time.Duration
+}
+
+// procs hands out ProcInfo from a queue common to all
+// threads; so an idle thread always picks up the next
+// ProcInfo, whichever thread queued it. ProcInfo are
+// processed in priority order, whether queued in memory or
+// spilled; spilled ProcInfo are kept in a spill queue per
+// priority, in the order they were spilled.
 type procs struct {
-	wg    *sync.WaitGroup
-	chans []proc
+	Frontier
+	log     log.Logger
+	mu      sync.Mutex
+	cond    *sync.Cond
+	queue   procQueue
+	seq     int64
+	spills  map[int]*spillQueue
+	order   []int // priorities of spills, lowest first
+	memory  int
+	spilled int
+	delayed int
+	pending int // queued, delayed or in process
+	done    int
+	closed  bool
 }
 
-// 1) Pull off from corresponding channel
+// 1) Pull off from the common queue
 // 2) Process request
-// 3) Remove from WaitGroup
-func (ps *procs) listen(l log.Logger, i int) {
+// 3) Queue resulting ProcInfo
+func (ps *procs) listen(l log.Logger, i int, wg *sync.WaitGroup) {
+	defer wg.Done()
 	l = l.New("thd", i)
-	for pi := range ps.chans[i] {
+	for {
+		pi, ok := ps.pop()
+		if !ok {
+			return
+		}
 		ps.spawnFill(pi.Fn(l, i))
-		ps.wg.Done()
+		ps.finish()
 	}
 }
 
-// 1) Add to WaitGroup
-// 2) Kick off process to fill channels
+// Queue ProcInfo, or start timers to
+// queue them later for delayed procs.
 func (ps *procs) spawnFill(pis []ProcInfo) {
-	if len(pis) > 0 {
-		ps.wg.Add(len(pis))
-		go ps.fill(pis)
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	for _, pi := range pis {
+		if d, ok := pi.(DelayedProc); ok {
+			ps.pending++
+			ps.delayed++
+			delayed := d.ProcInfo
+			time.AfterFunc(d.Delay, func() {
+				ps.mu.Lock()
+				defer ps.mu.Unlock()
+				ps.pending--
+				ps.delayed--
+				ps.queueMemory(delayed)
+			})
+		} else {
+			ps.push(pi)
+		}
 	}
 }
 
-// TODO: If we end up blocking on a channel
-// we can convert this to non-blocking by
-// utilizing a select and rotating through
-// the ProcInfo List to try other channels.
-func (ps *procs) fill(pis []ProcInfo) {
-	for len(pis) > 0 {
-		ps.chans[ChannelPicker(pis[0].String(), len(ps.chans))] <- pis[0]
-		pis = pis[1:]
+func priority(pi ProcInfo) int {
+	if p, ok := pi.(Prioritized); ok {
+		return p.Priority()
 	}
+	return 0
 }
 
-func ChannelPicker(str string, num int) int {
-	h := fnv.New64()
-	h.Write([]byte(str))
-	return int(h.Sum64() % uint64(num))
+// push queues a ProcInfo in memory, or spills it to disk if
+// the frontier is full; ps.mu must be held. ProcInfo that
+// fail to spill are kept in memory rather than lost.
+func (ps *procs) push(pi ProcInfo) {
+	if ps.Spiller != nil && ps.Max > 0 && ps.memory >= ps.Max {
+		priority := priority(pi)
+		b, err := ps.Spiller.Encode(pi)
+		if err == nil {
+			err = ps.spillQueue(priority).push(b)
+		}
+		if err == nil {
+			ps.pending++
+			ps.spilled++
+			ps.cond.Signal()
+			return
+		}
+		ps.log.Warn("spill", "url", pi.String(), "err", err.Error())
+	}
+	ps.queueMemory(pi)
 }
 
-func Run(l log.Logger, num int, pis []ProcInfo) {
-	chans := make([]proc, num)
-	var wg sync.WaitGroup
-	ps := procs{wg: &wg, chans: chans}
-	for i := range chans {
-		chans[i] = make(proc, num)
-		go ps.listen(l, i)
+// queueMemory queues a ProcInfo in memory; ps.mu must be held.
+func (ps *procs) queueMemory(pi ProcInfo) {
+	ps.pending++
+	heap.Push(&ps.queue, queued{pi: pi, priority: priority(pi), seq: ps.seq})
+	ps.seq++
+	ps.memory++
+	ps.cond.Signal()
+}
+
+// spillQueue returns the spill queue of a priority,
+// creating it if needed; ps.mu must be held.
+func (ps *procs) spillQueue(priority int) *spillQueue {
+	sq, ok := ps.spills[priority]
+	if !ok {
+		sq = &spillQueue{dir: ps.Dir}
+		ps.spills[priority] = sq
+		i := sort.SearchInts(ps.order, priority)
+		ps.order = append(ps.order, 0)
+		copy(ps.order[i+1:], ps.order[i:])
+		ps.order[i] = priority
+	}
+	return sq
+}
+
+// nextSpill returns the lowest priority spill queue holding
+// spilled ProcInfo; or nil if none do. ps.mu must be held.
+func (ps *procs) nextSpill() (int, *spillQueue) {
+	for _, priority := range ps.order {
+		if sq := ps.spills[priority]; sq.n > 0 {
+			return priority, sq
+		}
+	}
+	return 0, nil
+}
+
+// pop waits for the next queued ProcInfo; the lowest
+// priority of those in memory and spilled, memory first
+// between equals. It returns false once the queue is empty
+// and no ProcInfo remain in process or delayed.
+func (ps *procs) pop() (ProcInfo, bool) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	for {
+		priority, sq := ps.nextSpill()
+		if ps.queue.Len() > 0 && (sq == nil || ps.queue[0].priority <= priority) {
+			ps.memory--
+			return heap.Pop(&ps.queue).(queued).pi, true
+		}
+		if sq != nil {
+			ps.spilled--
+			b, err := sq.pop()
+			var pi ProcInfo
+			if err == nil {
+				pi, err = ps.Spiller.Decode(b)
+			}
+			if err == nil {
+				return pi, true
+			}
+			ps.log.Error("spill", "err", err.Error())
+			ps.pending--
+			continue
+		}
+		if ps.closed || ps.pending == 0 {
+			ps.close()
+			return nil, false
+		}
+		ps.cond.Wait()
+	}
+}
+
+// finish marks a popped ProcInfo as processed.
+func (ps *procs) finish() {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.pending--
+	ps.done++
+	if ps.pending == 0 {
+		ps.close()
+	}
+}
+
+// close wakes all threads to exit; ps.mu must be held.
+func (ps *procs) close() {
+	if !ps.closed {
+		ps.closed = true
+		ps.cond.Broadcast()
+	}
+}
+
+func (ps *procs) progress() {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.log.Info("progress", "frontier", ps.memory+ps.spilled, "memory", ps.memory, "spilled", ps.spilled, "delayed", ps.delayed, "active", ps.pending-ps.memory-ps.spilled-ps.delayed, "done", ps.done)
+}
+
+func Run(l log.Logger, num int, f Frontier, pis []ProcInfo) {
+	ps := procs{Frontier: f, log: l, spills: make(map[int]*spillQueue)}
+	ps.cond = sync.NewCond(&ps.mu)
+	defer func() {
+		for _, sq := range ps.spills {
+			sq.close()
+		}
+	}()
+	if f.Progress > 0 {
+		// Stop does not close the ticker's channel;
+		// so the done channel ends the goroutine.
+		ticker := time.NewTicker(f.Progress)
+		done := make(chan struct{})
+		defer func() {
+			ticker.Stop()
+			close(done)
+		}()
+		go func() {
+			for {
+				select {
+				case <-ticker.C:
+					ps.progress()
+				case <-done:
+					return
+				}
+			}
+		}()
 	}
 	ps.spawnFill(pis)
-	wg.Wait()
-	for _, ch := range chans {
-		close(ch)
+	var wg sync.WaitGroup
+	wg.Add(num)
+	for i := 0; i < num; i++ {
+		go ps.listen(l, i, &wg)
 	}
+	wg.Wait()
 }
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"runtime"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	log "gopkg.in/inconshreveable/log15.v2"
+)
+
+// testProc is a ProcInfo that records when it is processed,
+// and queues its children.
+type testProc struct {
+	Name     string
+	Prio     int
+	Children []testProc
+	run      *testRun
+}
+
+// testRun records the order testProcs are processed in,
+// and the number spilled.
+type testRun struct {
+	mu      sync.Mutex
+	names   []string
+	prios   []int
+	spilled int
+}
+
+func (p testProc) String() string { return p.Name }
+func (p testProc) Priority() int  { return p.Prio }
+func (p testProc) Fn(l log.Logger, i int) []ProcInfo {
+	p.run.mu.Lock()
+	p.run.names = append(p.run.names, p.Name)
+	p.run.prios = append(p.run.prios, p.Prio)
+	p.run.mu.Unlock()
+	var pis []ProcInfo
+	for _, c := range p.Children {
+		c.run = p.run
+		pis = append(pis, c)
+	}
+	return pis
+}
+
+// Encode and Decode spill testProcs as JSON.
+func (r *testRun) Encode(pi ProcInfo) ([]byte, error) {
+	r.spilled++
+	return json.Marshal(pi.(testProc))
+}
+
+func (r *testRun) Decode(b []byte) (ProcInfo, error) {
+	var p testProc
+	err := json.Unmarshal(b, &p)
+	p.run = r
+	return p, err
+}
+
+// Every ProcInfo is processed once, whether queued in memory
+// or spilled; only ProcInfo beyond the frontier are spilled.
+func TestRunSpill(t *testing.T) {
+	for _, max := range []int{0, 1, 5, 1000} {
+		for _, num := range []int{1, 4} {
+			run := &testRun{}
+			root := testProc{Name: "root", run: run}
+			for i := 0; i < 60; i++ {
+				root.Children = append(root.Children, testProc{Name: fmt.Sprint(i), Children: []testProc{{Name: fmt.Sprint(i, "/child")}}})
+			}
+			Run(discardLog(), num, Frontier{Max: max, Spiller: run}, []ProcInfo{root})
+			seen := make(map[string]bool)
+			for _, name := range run.names {
+				if seen[name] {
+					t.Errorf("max %d threads %d: %s processed twice", max, num, name)
+				}
+				seen[name] = true
+			}
+			if len(seen) != 121 {
+				t.Errorf("max %d threads %d: processed %d, want 121", max, num, len(seen))
+			}
+			if spilled := run.spilled > 0; spilled != (max > 0 && max < 60) {
+				t.Errorf("max %d threads %d: spilled %d", max, num, run.spilled)
+			}
+		}
+	}
+}
+
+// Spilled ProcInfo are merged with those queued in memory by
+// priority; so a bounded frontier keeps breadth first order.
+func TestRunSpillOrder(t *testing.T) {
+	for _, max := range []int{0, 1, 5, 1000} {
+		run := &testRun{}
+		root := testProc{Name: "root", run: run}
+		for i := 0; i < 60; i++ {
+			root.Children = append(root.Children, testProc{Name: fmt.Sprint(i), Prio: (i * 7) % 5})
+		}
+		Run(discardLog(), 1, Frontier{Max: max, Spiller: run}, []ProcInfo{root})
+		if len(run.names) != 61 {
+			t.Fatalf("max %d: processed %d, want 61", max, len(run.names))
+		}
+		for i := 2; i < len(run.prios); i++ {
+			if run.prios[i] < run.prios[i-1] {
+				t.Errorf("max %d: priority %d processed after %d: %v", max, run.prios[i], run.prios[i-1], run.prios)
+				break
+			}
+		}
+		// Equal priorities keep the order they were queued in.
+		for i := 2; i < len(run.names); i++ {
+			if run.prios[i] == run.prios[i-1] && atoi(run.names[i]) < atoi(run.names[i-1]) {
+				t.Errorf("max %d: %s processed after %s: %v", max, run.names[i], run.names[i-1], run.names)
+				break
+			}
+		}
+	}
+}
+
+func atoi(s string) int {
+	n, _ := strconv.Atoi(s)
+	return n
+}
+
+// A delayed ProcInfo is queued once its delay has passed, and
+// Run only returns once it has been processed.
+func TestRunDelayed(t *testing.T) {
+	run := &testRun{}
+	start := time.Now()
+	Run(discardLog(), 4, Frontier{Max: 1, Spiller: run}, []ProcInfo{
+		DelayedProc{ProcInfo: testProc{Name: "late", run: run}, Delay: 20 * time.Millisecond},
+		testProc{Name: "a", run: run, Children: []testProc{{Name: "b"}, {Name: "c"}}},
+	})
+	if len(run.names) != 4 || run.names[3] != "late" {
+		t.Errorf("processed %v, want late last", run.names)
+	}
+	if time.Since(start) < 20*time.Millisecond {
+		t.Error("delayed ProcInfo processed early")
+	}
+}
+
+// Delayed ProcInfo are kept in memory even once the frontier
+// is full, as they may hold claims other ProcInfo wait on.
+func TestRunDelayedInMemory(t *testing.T) {
+	run := &testRun{}
+	ps := procs{Frontier: Frontier{Max: 1, Spiller: run}, log: discardLog(), spills: make(map[int]*spillQueue)}
+	ps.cond = sync.NewCond(&ps.mu)
+	ps.spawnFill([]ProcInfo{testProc{Name: "a"}, DelayedProc{ProcInfo: testProc{Name: "late"}}})
+	for i := 0; i < 100; i++ {
+		ps.mu.Lock()
+		delayed := ps.delayed
+		ps.mu.Unlock()
+		if delayed == 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if ps.memory != 2 || ps.spilled != 0 || run.spilled != 0 {
+		t.Errorf("%d in memory and %d spilled, want 2 and 0", ps.memory, ps.spilled)
+	}
+}
+
+// Progress is logged while running, and the progress
+// goroutine exits once Run returns.
+func TestRunProgress(t *testing.T) {
+	before := runtime.NumGoroutine()
+	tl := &testLog{}
+	for i := 0; i < 10; i++ {
+		run := &testRun{}
+		Run(tl.logger(), 2, Frontier{Progress: time.Millisecond}, []ProcInfo{
+			DelayedProc{ProcInfo: testProc{Name: "late", run: run}, Delay: 5 * time.Millisecond},
+		})
+	}
+	for i := 0; i < 100 && runtime.NumGoroutine() > before; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if after := runtime.NumGoroutine(); after > before {
+		t.Errorf("%d goroutines left running after Run", after-before)
+	}
+	if len(tl.find("progress")) == 0 {
+		t.Error("no progress logged")
+	}
+}
+
+// sleepProc is a ProcInfo taking a while to process,
+// recording how many are processed at once.
+type sleepProc struct {
+	name     string
+	children int
+	active   *concurrency
+}
+
+type concurrency struct {
+	mu     sync.Mutex
+	active int
+	max    int
+}
+
+func (p sleepProc) String() string { return p.name }
+func (p sleepProc) Fn(l log.Logger, i int) []ProcInfo {
+	p.active.mu.Lock()
+	p.active.active++
+	if p.active.active > p.active.max {
+		p.active.max = p.active.active
+	}
+	p.active.mu.Unlock()
+	time.Sleep(20 * time.Millisecond)
+	p.active.mu.Lock()
+	p.active.active--
+	p.active.mu.Unlock()
+	var pis []ProcInfo
+	for c := 0; c < p.children; c++ {
+		pis = append(pis, sleepProc{name: fmt.Sprintf("%s/%d", p.name, c), active: p.active})
+	}
+	return pis
+}
+
+// ProcInfo queued by one thread are picked up by all idle
+// threads from the common queue.
+func TestRunCommonQueue(t *testing.T) {
+	active := &concurrency{}
+	start := time.Now()
+	Run(discardLog(), 8, Frontier{}, []ProcInfo{sleepProc{name: "root", children: 16, active: active}})
+	if active.max != 8 {
+		t.Errorf("at most %d processed at once, want 8", active.max)
+	}
+	// The root and two rounds of 8 children; 340ms on one thread.
+	if elapsed := time.Since(start); elapsed > 200*time.Millisecond {
+		t.Errorf("took %v, want about 60ms", elapsed)
+	}
+}
@@ -0,0 +1,212 @@
+// On-disk key value store of visited url statuses (kvstore)
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	log "gopkg.in/inconshreveable/log15.v2"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Header identifying visited store files.
+const diskStoreMagic = "thrawler-visited 1\n"
+
+type ErrDiskStore struct {
+	path string
+}
+
+func (e ErrDiskStore) Error() string {
+	return "Not a visited store file: '" + e.path + "'"
+}
+
+type ErrDiskStoreRecord struct {
+	off int64
+}
+
+func (e ErrDiskStoreRecord) Error() string {
+	return "Corrupt visited store record at offset " + strconv.FormatInt(e.off, 10)
+}
+
+// DiskStore is an embedded key value store of url statuses
+// kept in a file; so the statuses of a crawl outlive it and
+// may be queried afterwards. The file is an append only log
+// of records, each a varint length prefixed url followed by
+// its varint status; the latest record of a url holds its
+// status. Only an index of url hashes to record offsets is
+// kept in memory, and lookups read the record from disk.
+type DiskStore struct {
+	mu    sync.Mutex
+	f     *os.File
+	size  int64
+	index map[uint64][]int64
+}
+
+// OpenDiskStore opens an existing store file; or with
+// truncate, creates or empties it for a new crawl. A partially
+// written record at the end of the file, left by a crash, is
+// dropped.
+func OpenDiskStore(path string, truncate bool) (*DiskStore, error) {
+	flags := os.O_RDWR
+	if truncate {
+		flags |= os.O_CREATE | os.O_TRUNC
+	}
+	f, err := os.OpenFile(path, flags, 0644)
+	if err != nil {
+		return nil, err
+	}
+	s := &DiskStore{f: f, index: make(map[uint64][]int64)}
+	if err := s.load(path); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *DiskStore) load(path string) error {
+	info, err := s.f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() == 0 {
+		_, err := s.f.WriteAt([]byte(diskStoreMagic), 0)
+		s.size = int64(len(diskStoreMagic))
+		return err
+	}
+	in := bufio.NewReader(io.NewSectionReader(s.f, 0, info.Size()))
+	magic := make([]byte, len(diskStoreMagic))
+	if _, err := io.ReadFull(in, magic); err != nil || string(magic) != diskStoreMagic {
+		return ErrDiskStore{path: path}
+	}
+	off := int64(len(magic))
+	for {
+		n, err := binary.ReadUvarint(in)
+		if err != nil {
+			break
+		}
+		url := make([]byte, n)
+		if _, err := io.ReadFull(in, url); err != nil {
+			break
+		}
+		stat, err := binary.ReadVarint(in)
+		if err != nil {
+			break
+		}
+		h := urlHash(string(url))
+		s.index[h] = s.replace(s.index[h], string(url), off)
+		off += int64(recordLen(string(url), int(stat)))
+	}
+	s.size = off
+	if off < info.Size() {
+		return s.f.Truncate(off)
+	}
+	return nil
+}
+
+// recordLen returns the length of a url's record; varints
+// are read back from the same bytes they were written as.
+func recordLen(url string, stat int) int {
+	b := make([]byte, binary.MaxVarintLen64)
+	return binary.PutUvarint(b, uint64(len(url))) + len(url) + binary.PutVarint(b, int64(stat))
+}
+
+// record reads the url and status of the record at an offset;
+// a record without its length or status varint is corrupt.
+func (s *DiskStore) record(off int64) (string, int, error) {
+	b := make([]byte, binary.MaxVarintLen64)
+	n, err := s.f.ReadAt(b, off)
+	if n == 0 {
+		return "", 0, err
+	}
+	size, l := binary.Uvarint(b[:n])
+	if l <= 0 {
+		return "", 0, ErrDiskStoreRecord{off: off}
+	}
+	b = make([]byte, int(size)+binary.MaxVarintLen64)
+	n, err = s.f.ReadAt(b, off+int64(l))
+	if n < int(size) {
+		return "", 0, err
+	}
+	stat, sl := binary.Varint(b[size:n])
+	if sl <= 0 {
+		return "", 0, ErrDiskStoreRecord{off: off}
+	}
+	return string(b[:size]), int(stat), nil
+}
+
+// replace returns the offsets of a hash with the url's
+// previous record, if any, replaced by the new offset.
+func (s *DiskStore) replace(offs []int64, url string, off int64) []int64 {
+	for i, o := range offs {
+		if u, _, err := s.record(o); err == nil && u == url {
+			offs[i] = off
+			return offs
+		}
+	}
+	return append(offs, off)
+}
+
+func (s *DiskStore) Get(url string) (int, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, off := range s.index[urlHash(url)] {
+		if u, stat, err := s.record(off); err == nil && u == url {
+			return stat, true
+		}
+	}
+	return 0, false
+}
+
+func (s *DiskStore) Put(url string, stat int) error {
+	rec := make([]byte, 2*binary.MaxVarintLen64+len(url))
+	n := binary.PutUvarint(rec, uint64(len(url)))
+	n += copy(rec[n:], url)
+	n += binary.PutVarint(rec[n:], int64(stat))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.f.WriteAt(rec[:n], s.size); err != nil {
+		return err
+	}
+	h := urlHash(url)
+	s.index[h] = s.replace(s.index[h], url, s.size)
+	s.size += int64(n)
+	return nil
+}
+
+func (s *DiskStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.f.Sync(); err != nil {
+		s.f.Close()
+		return err
+	}
+	return s.f.Close()
+}
+
+// Query logs the status recorded in the store file for each
+// url read from in; so the results of a crawl run with a disk
+// store may be looked up afterwards. Urls are canonicalized
+// the same as when crawling, when possible.
+func Query(l log.Logger, path string, canon Canon, in io.Reader) error {
+	s, err := OpenDiskStore(path, false)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		url := strings.TrimSpace(scanner.Text())
+		if url == "" {
+			continue
+		}
+		if li, err := canon(LinkInfo{}, url); err == nil {
+			url = li.String()
+		}
+		stat, ok := s.Get(url)
+		l.Info("visited", "url", url, "code", stat, "found", ok)
+	}
+	return scanner.Err()
+}
@@ -10,6 +10,7 @@ import (
 	"os"
 	"regexp"
 	"strings"
+	"time"
 )
 
 type FindReplace struct {
@@ -18,10 +19,41 @@ type FindReplace struct {
 }
 
 type Config struct {
-	base     *regexp.Regexp
-	matchers []FindReplace
+	base      *regexp.Regexp
+	matchers  []FindReplace
+	soft404   Soft404
+	forbidden Forbiddens
+	volatile  Volatiles
+	asserts   Asserts
+	budgets   Budgets
+	headers   Headers
+	scopes    ScopeBudgets
+	boosts    Boosts
+	auths     Auths
+	logins    Logins
 }
 
+// Config file sections following the base domain filter
+// and find/replace entries. Each section starts with its
+// [name] on a line of its own, followed by entries of tab
+// delimited fields; each entry is handed to the Parse method
+// of the section's Config field, which returns an error for
+// entries it does not accept.
+var sections = map[string]func(*Config, []string) error{
+	"soft404":   func(c *Config, fields []string) error { return c.soft404.Parse(fields) },
+	"forbidden": func(c *Config, fields []string) error { return c.forbidden.Parse(fields) },
+	"volatile":  func(c *Config, fields []string) error { return c.volatile.Parse(fields) },
+	"assert":    func(c *Config, fields []string) error { return c.asserts.Parse(fields) },
+	"budget":    func(c *Config, fields []string) error { return c.budgets.Parse(fields) },
+	"header":    func(c *Config, fields []string) error { return c.headers.Parse(fields) },
+	"scope":     func(c *Config, fields []string) error { return c.scopes.Parse(fields) },
+	"priority":  func(c *Config, fields []string) error { return c.boosts.Parse(fields) },
+	"auth":      func(c *Config, fields []string) error { return c.auths.Parse(fields) },
+	"login":     func(c *Config, fields []string) error { return c.logins.Parse(fields) },
+}
+
+var reSection = regexp.MustCompile(`^\[([a-z0-9-]+)\]$`)
+
 type ErrNoBaseDomain struct{}
 
 func (e ErrNoBaseDomain) Error() string {
@@ -30,58 +62,146 @@ func (e ErrNoBaseDomain) Error() string {
 
 type ErrConfigFile struct {
 	line string
+	err  error
 }
 
 func (e ErrConfigFile) Error() string {
+	if e.err != nil {
+		return fmt.Sprintf("Config file issue with following line '%s': %s", e.line, e.err.Error())
+	}
 	return fmt.Sprintf("Config file issue with following line '%s'", e.line)
 }
 
 var crawl bool
+var nthchild bool
+var access bool
+var canonical bool
+var slow time.Duration
+var slowest int
+var cacert string
+var cert string
+var key string
+var insecure bool
+var expiry int
+var fallback string
+var retries int
+var retrycodes string
+var retrywait time.Duration
+var retrymax time.Duration
 var configfile string
 var threads int
 var proxy string
-var headers []Header
+var noproxy string
+var resolves = Resolves{}
+var cookies string
+var compress bool
+var maxbody string
+var record string
+var recordmax string
+var replay string
+var frontier int
+var spilldir string
+var progress time.Duration
+var maxdepth int
+var maxpages int
+var visitedspec string
+var query string
+var headers Headers
+var headerfile string
 var wd string
 
 func init() {
 	flag.BoolVar(&crawl, "crawl", true, "If false then only the intially supplied list of sites will be parsed for links. All generated links will only be validated to exist. If true then all generated links will also be parsed for links to be crawled recursively.")
+	flag.BoolVar(&nthchild, "nth-child", false, "If true then each element in the logged tag location path includes its :nth-child(n) index; so each path uniquely identifies where a link was found on the page.")
+	flag.BoolVar(&access, "a11y", false, "If true then html pages are also checked for accessibility issues such as images without alt text, links without accessible text, unlabeled form inputs, missing lang attributes, skipped heading levels and duplicate link text pointing to different URLs.")
+	flag.BoolVar(&canonical, "canonical", false, "If true then each html page's declared <link rel=\"canonical\"> url is canonicalized and compared with the page's own canonical url; reporting missing and mismatched canonicals, as well as canonicals that do not return a 200 status.")
+	flag.DurationVar(&slow, "slow", 0, "GET requests taking longer than this duration, e.g. 5s, are logged as slow. Zero disables slow request warnings.")
+	flag.IntVar(&slowest, "slowest", 10, "Number of slowest GET requested pages listed in the summary logged once the crawl completes.")
+	flag.StringVar(&cacert, "cacert", "", "Path to a PEM bundle of CA certificates, such as an internal CA, trusted in addition to the system's when verifying https hosts.")
+	flag.StringVar(&cert, "cert", "", "Path to a PEM client certificate presented to https hosts requiring one.")
+	flag.StringVar(&key, "key", "", "Path to the PEM private key of the client certificate. Defaults to the --cert file.")
+	flag.BoolVar(&insecure, "insecure", false, "If true then https server certificates are NOT verified. Only use this for hosts whose certificates cannot be verified otherwise.")
+	flag.IntVar(&expiry, "cert-expiry", 30, "Warn of https host certificates expiring within this number of days.")
+	flag.StringVar(&fallback, "head-fallback", "403,405,501", "Comma delimited status codes of HEAD responses retried with a ranged GET request. Hosts whose GET succeeds are remembered, and all their existence checks are made with GET requests.")
+	flag.IntVar(&retries, "retries", 0, "Number of times a request failing with a connection error, timeout or one of the --retry-codes is retried. Zero, the default, disables retries.")
+	flag.StringVar(&retrycodes, "retry-codes", "429,502,503,504", "Comma delimited status codes of responses that are retried.")
+	flag.DurationVar(&retrywait, "retry-wait", time.Second, "Initial delay before retrying a request, doubled with each following attempt and randomized with jitter. Retry-After response headers take precedence.")
+	flag.DurationVar(&retrymax, "retry-max-wait", time.Minute, "Maximum delay before retrying a request, including Retry-After delays.")
 	flag.StringVar(&configfile, "conf", "config", "Path to configuration file used to help canonicalize gathered URLs, and to filter by base domain.")
 	flag.IntVar(&threads, "threads", 20, "Number of threads used to crawl site.")
-	flag.StringVar(&proxy, "proxy", "", "Proxy to send traffic to. Generally a load balancer.")
+	flag.StringVar(&proxy, "proxy", "", "Proxy to send traffic to. Generally a load balancer. May be an http://, https:// or socks5:// proxy url.")
+	flag.StringVar(&noproxy, "no-proxy", "", "Comma delimited list of hosts, and their subdomains, whose requests are NOT sent to the proxy. Use * for all hosts.")
+	flag.Var(resolves, "resolve", "Dial the address of a host:port pair instead of resolving its host, like curl's --resolve host:port:addr option. The Host header and TLS SNI still use the host. May be given more than once.")
+	flag.StringVar(&cookies, "cookies", "", "Path to a cookie jar file loaded before crawling and saved once the crawl completes; so sessions started by [login] config entries may be reused by following crawls.")
+	flag.BoolVar(&compress, "compress", false, "If true then gzip and brotli compressed responses are requested and decoded, as browsers would receive them. Off by default as Magnolia CMS gzip responses have a 2GB limit.")
+	flag.StringVar(&maxbody, "max-body-size", "text/html=20M,text/css=5M,*=10M", "Comma delimited content type and size pairs limiting the decoded size of response bodies read. Types may be a media type, a major type such as image/* or * for all others. Larger bodies are truncated and logged. A size of 0 means no limit.")
+	flag.StringVar(&headerfile, "headers", "", "Path to a file of tab delimited profile, url regexp and header entries, in the same form as the [header] config file section.")
+	flag.StringVar(&record, "record", "", "Path to a WARC file, or a HAR file if the name ends with .har, that every request and response is recorded to.")
+	flag.StringVar(&recordmax, "record-max-body", "1M", "Size of the largest response body recorded; larger bodies are truncated. Sizes may use a K, M or G suffix, and 0 means no limit.")
+	flag.StringVar(&replay, "replay", "", "Path to a WARC or HAR file recorded by an earlier crawl. All responses are served from the archive instead of the network.")
+	flag.IntVar(&frontier, "frontier", 100000, "Number of links queued in memory to be requested. Further links are spilled to temporary files until the queue drains; so memory use stays flat regardless of site size. Zero means no limit.")
+	flag.StringVar(&spilldir, "spill-dir", "", "Directory of the temporary files links are spilled to. Defaults to the system's temporary directory.")
+	flag.DurationVar(&progress, "progress", 30*time.Second, "Interval between progress entries logging the size of the frontier of queued links. Zero disables progress entries.")
+	flag.IntVar(&maxdepth, "max-depth", -1, "Html pages more than this number of link hops from a seed are not crawled for links, only checked to exist. A negative depth means no limit.")
+	flag.IntVar(&maxpages, "max-pages", 0, "Html pages beyond this number are not crawled for links, only checked to exist. Zero means no limit.")
+	flag.StringVar(&visitedspec, "visited", "map", "Store of the status code of each visited url: map keeps every url in memory; hash keeps a compact table of 64 bit url hashes for huge crawls; disk:path keeps them in an on-disk store file that outlives the crawl. Prefixing a store with bloom:, e.g. bloom:disk:path, fronts it with a bloom filter answering most lookups of unvisited urls.")
+	flag.StringVar(&query, "query", "", "Path to a store file written by --visited=disk:path. Instead of crawling, the status recorded for each url read from standard input is logged.")
+}
+
+// parseArgs parses the command line; in main rather than
+// init so that go test may parse its own flags.
+func parseArgs() {
 	flag.Parse()
-	// Handle headers separately as multi arguments so that we
-	// can allow for multiple headers:
-	// +header="h1:v1" +header="h2:v2" ...
-	if flag.NArg() > 0 {
-		for _, f := range flag.Args() {
-			if strings.HasPrefix(f, "+header=") && len(f) > 9 {
-				h := strings.SplitN(f[8:], ":", 2)
-				if len(h) == 2 {
-					h[0] = strings.TrimSpace(h[0])
-					h[1] = strings.TrimSpace(h[1])
-					if h[0] != "" && h[1] != "" {
-						headers = append(headers, Header{Name: h[0], Val: h[1]})
-					}
+	headers = append(headers, headerArgs(flag.Args())...)
+	wd, _ = os.Getwd()
+}
+
+// headerArgs handles headers separately as multi arguments so
+// that we can allow for multiple headers, added to all requests:
+// +header="h1:v1" +header="h2:v2" ...
+func headerArgs(args []string) Headers {
+	var hs Headers
+	for _, f := range args {
+		if strings.HasPrefix(f, "+header=") && len(f) > 9 {
+			h := strings.SplitN(f[8:], ":", 2)
+			if len(h) == 2 {
+				h[0] = strings.TrimSpace(h[0])
+				h[1] = strings.TrimSpace(h[1])
+				if h[0] != "" && h[1] != "" {
+					hs = append(hs, Header{Name: h[0], Val: h[1]})
 				}
 			}
 		}
 	}
-	// http://stackoverflow.com/questions/14661511/setting-up-proxy-for-http-client
-	if proxy != "" {
-		// EX: proxy = "http://gato-public.its.txstate.edu" or "http://localhost:8080"
-		os.Setenv("HTTP_PROXY", proxy)
-	}
-	wd, _ = os.Getwd()
+	return hs
 }
 
 func NewConfig(config io.Reader) (Config, error) {
+	var c Config
 	var base *regexp.Regexp
 	var matchers []FindReplace
+	var section string
 	scanner := bufio.NewScanner(config)
 	for scanner.Scan() {
 		conf := strings.TrimSpace(scanner.Text())
 		if !strings.HasPrefix(conf, "#") {
-			if base == nil {
+			if m := reSection.FindStringSubmatch(conf); m != nil && base != nil {
+				if _, ok := sections[m[1]]; !ok {
+					return Config{}, ErrConfigFile{line: conf}
+				}
+				section = m[1]
+			} else if section != "" {
+				if conf != "" {
+					if err := sections[section](&c, strings.Split(conf, "\t")); err != nil {
+						// Keep the underlying error of regexps,
+						// credentials and such.
+						if _, ok := err.(ErrConfigFile); ok {
+							return Config{}, err
+						}
+						return Config{}, ErrConfigFile{line: conf, err: err}
+					}
+				}
+			} else if base == nil {
 				base = regexp.MustCompile(conf)
 			} else {
 				fr := strings.SplitN(conf, "\t", 2)
@@ -99,7 +219,9 @@ func NewConfig(config io.Reader) (Config, error) {
 	if base == nil {
 		return Config{}, ErrNoBaseDomain{}
 	}
-	return Config{base: base, matchers: matchers}, nil
+	c.base = base
+	c.matchers = matchers
+	return c, nil
 }
 
 // Gato specific wrapper for canonicalize
@@ -153,6 +275,7 @@ func NewCanonicalize(config Config) (Canon, error) {
 }
 
 func main() {
+	parseArgs()
 	if !strings.HasPrefix(configfile, "/") {
 		configfile = wd + "/" + configfile
 	}
@@ -175,6 +298,59 @@ func main() {
 		log.LvlFilterHandler(
 			log.LvlDebug,
 			log.StreamHandler(os.Stdout, log.JsonFormat())))
+	if query != "" {
+		if err := Query(mainlog, query, canon, os.Stdin); err != nil {
+			panic("Error querying '" + query + "' visited store: " + err.Error())
+		}
+		return
+	}
+	tlsconf, err := NewTLSConfig(cacert, cert, key, insecure)
+	if err != nil {
+		panic("Error setting up TLS configuration: " + err.Error())
+	}
+	heads, err := NewHeads(fallback)
+	if err != nil {
+		panic("Error parsing --head-fallback status codes: " + err.Error())
+	}
+	retry, err := NewRetries(retries, retrycodes, retrywait, retrymax)
+	if err != nil {
+		panic("Error parsing --retry-codes status codes: " + err.Error())
+	}
+	headers = append(headers, conf.headers...)
+	if headerfile != "" {
+		hf, err := os.Open(headerfile)
+		if err != nil {
+			panic("Error opening '" + headerfile + "' headers file: " + err.Error())
+		}
+		err = headers.Load(hf)
+		hf.Close()
+		if err != nil {
+			panic("Error processing headers file: " + err.Error())
+		}
+	}
+	bodies, err := NewBodies(compress, maxbody)
+	if err != nil {
+		panic("Error parsing --max-body-size limits: " + err.Error())
+	}
+	maxrecord, err := parseBytes(recordmax)
+	if err != nil {
+		panic("Error parsing --record-max-body size: " + err.Error())
+	}
+	recorder, err := NewRecorder(record, maxrecord)
+	if err != nil {
+		panic("Error creating --record archive: " + err.Error())
+	}
+	replayer, err := NewReplay(replay)
+	if err != nil {
+		panic("Error loading --replay archive: " + err.Error())
+	}
+	proxyfn, err := NewProxy(proxy, noproxy)
+	if err != nil {
+		panic("Error parsing --proxy url: " + err.Error())
+	}
+	if insecure {
+		mainlog.Warn("insecure", "err", "https server certificates will not be verified")
+	}
 	var sites []string
 	in := bufio.NewScanner(os.Stdin)
 	for in.Scan() {
@@ -183,7 +359,49 @@ func main() {
 	if err := in.Err(); err != nil {
 		panic("Error reading site list from standard input:" + err.Error())
 	}
-	Run(mainlog, threads, StartHtmlFilterLinks(threads, headers, canon, crawl, sites))
+	for _, site := range sites {
+		if _, profile := splitSeed(site); profile != "" && !headers.Profile(profile) {
+			panic("Error reading site list from standard input: unknown header profile '" + profile + "'")
+		}
+	}
+	store, err := NewVisitedStore(visitedspec)
+	if err != nil {
+		panic("Error opening --visited store: " + err.Error())
+	}
+	envs := Envs{visited: NewVisited(store), headers: headers, canon: canon, crawl: crawl, nthchild: nthchild, soft404: conf.soft404, forbidden: conf.forbidden, volatile: conf.volatile, asserts: conf.asserts, access: access, dupes: NewDuplicates(), timings: NewTimings(slow, slowest), weights: NewWeights(conf.budgets), tlsconf: tlsconf, certs: NewCerts(expiry), heads: heads, retries: retry, proxy: proxyfn, resolve: resolves, auths: conf.auths, bodies: bodies, recorder: recorder, replay: replayer, scopes: NewScopes(maxdepth, maxpages, conf.scopes), boosts: conf.boosts}
+	if cookies != "" || len(conf.logins) > 0 {
+		if envs.jar, err = NewJar(cookies); err != nil {
+			panic("Error loading --cookies jar file: " + err.Error())
+		}
+	}
+	if err := conf.logins.Login(mainlog, envs); err != nil {
+		panic("Error logging in: " + err.Error())
+	}
+	if canonical {
+		envs.canonicals = NewCanonicals()
+	}
+	envs.soft404.Learn(mainlog, envs, sites)
+	pis := StartHtmlFilterLinks(envs, sites)
+	Run(mainlog, threads, Frontier{Max: frontier, Dir: spilldir, Spiller: envs, Progress: progress}, pis)
+	envs.scopes.Report(mainlog)
+	envs.timings.Report(mainlog)
+	envs.dupes.Report(mainlog)
+	envs.weights.Report(mainlog)
+	envs.certs.Report(mainlog)
+	envs.canonicals.Report(mainlog, envs)
+	if err := envs.jar.Save(); err != nil {
+		mainlog.Error("cookies", "file", cookies, "err", err.Error())
+	}
+	if err := envs.recorder.Close(); err != nil {
+		mainlog.Error("record", "file", record, "err", err.Error())
+	}
+	if err := envs.visited.Close(); err != nil {
+		mainlog.Error("visited", "store", visitedspec, "err", err.Error())
+	}
+	if failed := envs.asserts.Failed(); failed > 0 {
+		mainlog.Error("asserts-failed", "count", failed)
+		os.Exit(1)
+	}
 }
 
 // Client Timeouts in Go:
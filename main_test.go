@@ -0,0 +1,29 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// Errors of section entries keep their underlying message.
+func TestNewConfigErrors(t *testing.T) {
+	tests := []struct {
+		conf string
+		err  string
+	}{
+		{"[auth]\n^https://	basic	env:THRAWLER_TEST_UNSET", "Credential must be env:NAME or file:path"},
+		{"[forbidden]\nunclosed	(a", "missing closing )"},
+		{"[budget]\n.	weight	3M", "Config file issue with following line '.\tweight\t3M'"},
+		{"[budget]\n.	total	-5M", "Invalid byte size: '-5M'"},
+		{"[nosuch]", "Config file issue with following line '[nosuch]'"},
+	}
+	for _, test := range tests {
+		_, err := NewConfig(strings.NewReader("^https://www\\.txstate\\.edu/\n" + test.conf + "\n"))
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%q: error %v, want %q", test.conf, err, test.err)
+		}
+	}
+	if _, err := NewConfig(strings.NewReader("^https://www\\.txstate\\.edu/\n[budget]\n.	total	3M\n")); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,79 @@
+// Priority scheduling of the crawl frontier (priority)
+package main
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+type Boost struct {
+	url    *regexp.Regexp
+	levels int
+}
+
+// Boosts move links matching a url regexp ahead in the crawl
+// by a number of depth levels; e.g. so key landing pages are
+// checked before a crawl is cut short. They are declared in
+// the [priority] section of the config file as tab delimited
+// url regexp and levels entries; the first match is used:
+//   ^https?://[^/]+/(index\.html)?$	2
+//   /imagehandler/	-1
+type Boosts []Boost
+
+func (bs *Boosts) Parse(fields []string) error {
+	if len(fields) != 2 {
+		return ErrConfigFile{line: strings.Join(fields, "\t")}
+	}
+	re, err := regexp.Compile(fields[0])
+	if err != nil {
+		return err
+	}
+	levels, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return err
+	}
+	*bs = append(*bs, Boost{url: re, levels: levels})
+	return nil
+}
+
+// Rank of each filter within a depth level; so pages
+// are crawled before their links are checked to exist.
+var filterRank = map[FilterType]int{
+	HTMLFILTER:  0,
+	CSSFILTER:   1,
+	EXISTFILTER: 2,
+}
+
+// Priority orders the crawl breadth first by depth, with
+// html pages ahead of stylesheets and existence checks of
+// the same depth. Boosted links may move ahead of shallower
+// links, but never ahead of the seeds; nor are the seeds,
+// at depth 0, themselves moved.
+func (e Envs) Priority(li LinkInfo, depth int, f FilterType) int {
+	level := depth
+	if depth > 0 {
+		for _, b := range e.boosts {
+			if b.url.MatchString(li.String()) {
+				level -= b.levels
+				break
+			}
+		}
+		if level < 1 {
+			level = 1
+		}
+	}
+	return level*len(filterRank) + filterRank[f]
+}
+
+func (link HtmlFilterLink) Priority() int {
+	return link.Envs.Priority(link.LinkInfo, link.depth, HTMLFILTER)
+}
+
+func (link CssFilterLink) Priority() int {
+	return link.Envs.Priority(link.LinkInfo, link.depth, CSSFILTER)
+}
+
+func (link ExistOnlyLink) Priority() int {
+	return link.Envs.Priority(link.LinkInfo, link.depth, EXISTFILTER)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestBoostsParse(t *testing.T) {
+	for _, test := range []struct {
+		line   string
+		levels int
+		err    bool
+	}{
+		{"^https?://[^/]+/(index\\.html)?$\t2", 2, false},
+		{"/imagehandler/\t-1", -1, false},
+		{"(\t2", 0, true},
+		{"/news/\ttwo", 0, true},
+		{"/news/", 0, true},
+	} {
+		var bs Boosts
+		err := bs.Parse(strings.Split(test.line, "\t"))
+		if (err != nil) != test.err {
+			t.Errorf("%q: error %v, want error %t", test.line, err, test.err)
+		} else if err == nil && (len(bs) != 1 || bs[0].levels != test.levels) {
+			t.Errorf("%q: boosts %v, want %d levels", test.line, bs, test.levels)
+		}
+	}
+}
+
+// Links are ordered by depth then filter; boosts move links by
+// depth levels, though never ahead of the seeds, and the seeds
+// themselves are never moved.
+func TestPriority(t *testing.T) {
+	envs := testEnvs(t, ".")
+	var bs Boosts
+	for _, line := range []string{"/landing\t2", "/far\t10", "/imagehandler/\t-1"} {
+		if err := bs.Parse(strings.Split(line, "\t")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	envs.boosts = bs
+	priority := func(path string, depth int, f FilterType) int {
+		li, err := envs.canon(LinkInfo{}, "http://www.txstate.edu"+path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return envs.Priority(li, depth, f)
+	}
+	for _, test := range []struct {
+		name        string
+		first, then int
+	}{
+		{"seeds ahead of their links", priority("/", 0, HTMLFILTER), priority("/a", 1, HTMLFILTER)},
+		{"shallower ahead", priority("/a", 1, EXISTFILTER), priority("/b", 2, HTMLFILTER)},
+		{"html ahead of css", priority("/a", 1, HTMLFILTER), priority("/a.css", 1, CSSFILTER)},
+		{"css ahead of existence checks", priority("/a.css", 1, CSSFILTER), priority("/a.png", 1, EXISTFILTER)},
+		{"boosted ahead of shallower", priority("/landing", 3, HTMLFILTER), priority("/b", 2, HTMLFILTER)},
+		{"lowered behind same depth", priority("/a.png", 1, EXISTFILTER), priority("/imagehandler/a.png", 1, EXISTFILTER)},
+		{"seeds ahead of boosted", priority("/", 0, EXISTFILTER), priority("/far", 1, HTMLFILTER)},
+		{"lowered seeds not moved", priority("/imagehandler/", 0, HTMLFILTER), priority("/a", 1, HTMLFILTER)},
+	} {
+		if test.first >= test.then {
+			t.Errorf("%s: priority %d not ahead of %d", test.name, test.first, test.then)
+		}
+	}
+	if lowered, deeper := priority("/imagehandler/a.png", 1, EXISTFILTER), priority("/b.png", 2, EXISTFILTER); lowered != deeper {
+		t.Errorf("lowered priority %d, want that of the next depth %d", lowered, deeper)
+	}
+	if seed, boosted := priority("/", 0, HTMLFILTER), priority("/landing", 0, HTMLFILTER); seed != boosted {
+		t.Errorf("boosted seed priority %d, want %d", boosted, seed)
+	}
+}
+
+// A single thread crawls breadth first, and boosted pages
+// ahead of shallower ones.
+func TestPriorityCrawl(t *testing.T) {
+	links := map[string]string{
+		"/":          `<a href="/a">a</a><a href="/b">b</a>`,
+		"/a":         `<a href="/a/deep">deep</a>`,
+		"/b":         `<a href="/b/deep">deep</a><a href="/b/landing">landing</a>`,
+		"/a/deep":    `<a href="/a/deeper">deeper</a>`,
+		"/b/deep":    ``,
+		"/a/deeper":  ``,
+		"/b/landing": ``,
+	}
+	var mu sync.Mutex
+	var gets []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, ok := links[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method == "GET" {
+			mu.Lock()
+			gets = append(gets, r.URL.Path)
+			mu.Unlock()
+		}
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, "<html><body>"+body+"</body></html>")
+	}))
+	defer ts.Close()
+	envs := testEnvs(t, regexp.QuoteMeta(ts.URL))
+	envs.boosts = Boosts{{url: regexp.MustCompile(`/landing$`), levels: 1}}
+	testCrawl(envs, 1, ts.URL+"/")
+	want := "[/ /a /b /b/landing /a/deep /b/deep /a/deeper]"
+	if fmt.Sprint(gets) != want {
+		t.Errorf("crawled %v, want %s", gets, want)
+	}
+}
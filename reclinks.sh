@@ -48,6 +48,12 @@ if [ $name == 'after' ]; then #after
     cat links.miss.diff
     cat links.miss.diff | mail -s "thrawler missed transmogrifiers $(hostname -f)" "$emails"
   fi
+  ./changed.py before.json after.json >pages.changed.txt
+  if [ -s "pages.changed.txt" ]; then
+    echo '========== Changed Page Content =========='
+    cat pages.changed.txt
+    wc pages.changed.txt | mail -s "thrawler changed pages $(hostname -f)" "$emails"
+  fi
   ./parity before.link.txt after.link.txt >links.diff
   if [ -s "links.diff" ]; then
     echo '========== Differing Links =========='
@@ -0,0 +1,114 @@
+// Retry policy for transient failures (retry)
+package main
+
+import (
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Retries is the policy for re-queuing requests that failed
+// with a connection error, timeout or one of the retry status
+// codes. Each retry waits an exponentially increasing delay,
+// with jitter, unless the response included a Retry-After
+// header; all delays are capped at maxwait.
+type Retries struct {
+	max     int
+	codes   map[int]bool
+	wait    time.Duration
+	maxwait time.Duration
+}
+
+// NewRetries returns a policy retrying a request up to max
+// times on the comma delimited status codes; e.g.
+// "429,502,503,504".
+func NewRetries(max int, codes string, wait time.Duration, maxwait time.Duration) (Retries, error) {
+	r := Retries{max: max, codes: make(map[int]bool), wait: wait, maxwait: maxwait}
+	for _, s := range strings.Split(codes, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			code, err := strconv.Atoi(s)
+			if err != nil {
+				return r, err
+			}
+			r.codes[code] = true
+		}
+	}
+	return r, nil
+}
+
+// Retry returns the delay before a failed request's next
+// attempt, and whether it should be retried at all. Attempts
+// are counted from zero for the initial request.
+func (r Retries) Retry(attempt int, res *http.Response, err error) (time.Duration, bool) {
+	if attempt >= r.max {
+		return 0, false
+	}
+	if err != nil {
+		// Redirects are reported as errors by the
+		// redirect policy and are not transient; nor
+		// are requests missing from a replay archive.
+		if ue, ok := err.(*url.Error); ok {
+			switch ue.Err.(type) {
+			case ErrRedirectTtlExceeded, ErrNotArchived:
+				return 0, false
+			}
+		}
+	} else if !r.codes[res.StatusCode] {
+		return 0, false
+	}
+	delay := r.wait << uint(attempt)
+	if delay <= 0 || delay > r.maxwait {
+		delay = r.maxwait
+	}
+	// Full jitter in the upper half of the delay spreads out
+	// retries of links that failed at the same time.
+	if delay > 1 {
+		delay = delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+	}
+	if res != nil {
+		if after, ok := retryAfter(res.Header.Get("Retry-After")); ok {
+			delay = after
+		}
+	}
+	if delay > r.maxwait {
+		delay = r.maxwait
+	}
+	return delay, true
+}
+
+// retryAfter parses a Retry-After header
+// given in either seconds or as an http date.
+func retryAfter(h string) (time.Duration, bool) {
+	h = strings.TrimSpace(h)
+	if h == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(h); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second, true
+	}
+	if t, err := http.ParseTime(h); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// Retry returns a copy of the link, of the type it was
+// originally queued as, to be queued again after a delay.
+func (ls *Links) Retry(f FilterType, delay time.Duration) ProcInfo {
+	var pi ProcInfo
+	switch f {
+	case HTMLFILTER:
+		pi = HtmlFilterLink{LinkInfo: ls.LinkInfo, Envs: ls.Envs, source: ls.source, attempt: ls.attempt + 1, depth: ls.depth}
+	case CSSFILTER:
+		pi = CssFilterLink{LinkInfo: ls.LinkInfo, Envs: ls.Envs, source: ls.source, attempt: ls.attempt + 1, depth: ls.depth}
+	default:
+		pi = ExistOnlyLink{LinkInfo: ls.LinkInfo, Envs: ls.Envs, source: ls.source, attempt: ls.attempt + 1, depth: ls.depth}
+	}
+	return DelayedProc{ProcInfo: pi, Delay: delay}
+}
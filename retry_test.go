@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRetryAfter(t *testing.T) {
+	tests := []struct {
+		header string
+		min    time.Duration
+		max    time.Duration
+		ok     bool
+	}{
+		{"", 0, 0, false},
+		{"soon", 0, 0, false},
+		{"-5", 0, 0, false},
+		{"0", 0, 0, true},
+		{" 120 ", 2 * time.Minute, 2 * time.Minute, true},
+		{time.Now().Add(time.Hour).UTC().Format(http.TimeFormat), 59 * time.Minute, time.Hour, true},
+		{time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat), 0, 0, true},
+	}
+	for _, test := range tests {
+		d, ok := retryAfter(test.header)
+		if ok != test.ok || d < test.min || d > test.max {
+			t.Errorf("retryAfter(%q) = %v, %v; want %v to %v, %v", test.header, d, ok, test.min, test.max, test.ok)
+		}
+	}
+}
+
+func TestRetries(t *testing.T) {
+	res := func(code int, after string) *http.Response {
+		res := &http.Response{StatusCode: code, Header: make(http.Header)}
+		if after != "" {
+			res.Header.Set("Retry-After", after)
+		}
+		return res
+	}
+	off, err := NewRetries(0, "503", time.Second, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, retry := off.Retry(0, res(503, ""), nil); retry {
+		t.Error("retried with no retries")
+	}
+	r, err := NewRetries(2, "429, 503", time.Second, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, retry := r.Retry(0, res(404, ""), nil); retry {
+		t.Error("retried a 404")
+	}
+	if _, retry := r.Retry(2, res(503, ""), nil); retry {
+		t.Error("retried beyond the maximum attempts")
+	}
+	// Backoff doubles with each attempt, with jitter in its upper half.
+	for attempt, max := range []time.Duration{time.Second, 2 * time.Second} {
+		delay, retry := r.Retry(attempt, res(503, ""), nil)
+		if !retry || delay < max/2 || delay > max {
+			t.Errorf("attempt %d: delay %v, %v; want %v to %v", attempt, delay, retry, max/2, max)
+		}
+	}
+	if delay, _ := r.Retry(0, res(429, "30"), nil); delay != 30*time.Second {
+		t.Errorf("Retry-After delay %v, want 30s", delay)
+	}
+	if delay, _ := r.Retry(0, res(429, "3600"), nil); delay != time.Minute {
+		t.Errorf("Retry-After delay %v, want the 1m maximum", delay)
+	}
+	if _, err := NewRetries(2, "503,five", time.Second, time.Minute); err == nil {
+		t.Error("parsed an invalid status code")
+	}
+}
+
+// A link failing with a retry status code is queued again,
+// and logged with its final status once it succeeds.
+func TestRetryCrawl(t *testing.T) {
+	var mu sync.Mutex
+	requests := make(map[string]int)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests[r.URL.Path]++
+		n := requests[r.URL.Path]
+		mu.Unlock()
+		switch r.URL.Path {
+		case "/":
+			w.Header().Set("Content-Type", "text/html")
+			fmt.Fprint(w, `<html><body><img src="/flaky.png"><img src="/down.png"></body></html>`)
+		case "/flaky.png":
+			if n == 1 {
+				w.WriteHeader(503)
+				return
+			}
+			w.Header().Set("Content-Type", "image/png")
+		default:
+			w.WriteHeader(503)
+		}
+	}))
+	defer ts.Close()
+	envs := testEnvs(t, regexp.QuoteMeta(ts.URL))
+	var err error
+	if envs.retries, err = NewRetries(2, "503", time.Millisecond, 10*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	tl := testCrawl(envs, 2, ts.URL+"/")
+	if requests["/flaky.png"] != 2 || requests["/down.png"] != 3 {
+		t.Errorf("requests %v, want 2 of flaky.png and 3 of down.png", requests)
+	}
+	retries := make(map[string][]interface{})
+	for _, ctx := range tl.find("retry") {
+		retries[ctx["url"].(string)] = append(retries[ctx["url"].(string)], ctx["attempt"])
+	}
+	if got := fmt.Sprint(retries[ts.URL+"/flaky.png"], retries[ts.URL+"/down.png"]); got != "[1] [1 2]" {
+		t.Errorf("retry attempts %s, want [1] [1 2]", got)
+	}
+	for _, ctx := range tl.find("req") {
+		if ctx["url"] == ts.URL+"/flaky.png" && ctx["code"] != 200 {
+			t.Errorf("flaky.png: code %v, want 200", ctx["code"])
+		}
+		if ctx["url"] == ts.URL+"/down.png" && (ctx["code"] != 503 || ctx["attempt"] != 3) {
+			t.Errorf("down.png: code %v attempt %v, want 503 and 3", ctx["code"], ctx["attempt"])
+		}
+	}
+}
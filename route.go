@@ -0,0 +1,103 @@
+// Proxy and host routing (route)
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+type ErrProxyScheme struct {
+	scheme string
+}
+
+func (e ErrProxyScheme) Error() string {
+	return "Proxy scheme must be http, https or socks5: '" + e.scheme + "'"
+}
+
+type ErrResolve struct {
+	entry string
+}
+
+func (e ErrResolve) Error() string {
+	return "Resolve entry must be of the form host:port:addr: '" + e.entry + "'"
+}
+
+// NewProxy returns the transport's Proxy function sending all
+// requests through an http, https or socks5 proxy; except for
+// requests to hosts in the comma delimited no-proxy list. As
+// with curl, a no-proxy entry matches its host and all of its
+// subdomains, and "*" matches all hosts.
+// EX: proxy = "http://gato-public.its.txstate.edu" or "socks5://localhost:1080"
+func NewProxy(proxy string, noproxy string) (func(*http.Request) (*url.URL, error), error) {
+	if proxy == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, ErrProxyScheme{scheme: u.Scheme}
+	}
+	var skip []string
+	for _, h := range strings.Split(noproxy, ",") {
+		if h = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(h), ".")); h != "" {
+			skip = append(skip, h)
+		}
+	}
+	return func(req *http.Request) (*url.URL, error) {
+		host := strings.ToLower(req.URL.Hostname())
+		for _, h := range skip {
+			if h == "*" || host == h || strings.HasSuffix(host, "."+h) {
+				return nil, nil
+			}
+		}
+		return u, nil
+	}, nil
+}
+
+// Resolves maps host:port addresses to the address actually
+// dialed, like curl's --resolve host:port:addr option. This
+// pins vhosts to a specific load balancer or node while the
+// Host header and TLS SNI still use the url's host.
+type Resolves map[string]string
+
+func (r Resolves) String() string {
+	var rs []string
+	for hostport, addr := range r {
+		rs = append(rs, hostport+":"+addr)
+	}
+	return strings.Join(rs, ",")
+}
+
+// Set adds a host:port:addr entry; addr may be
+// an IPv6 address with or without brackets.
+func (r Resolves) Set(entry string) error {
+	hpa := strings.SplitN(entry, ":", 3)
+	if len(hpa) != 3 || hpa[0] == "" || hpa[1] == "" || hpa[2] == "" {
+		return ErrResolve{entry: entry}
+	}
+	addr := strings.TrimSuffix(strings.TrimPrefix(hpa[2], "["), "]")
+	r[net.JoinHostPort(strings.ToLower(hpa[0]), hpa[1])] = net.JoinHostPort(addr, hpa[1])
+	return nil
+}
+
+var dialer = &net.Dialer{
+	Timeout:   30 * time.Second,
+	KeepAlive: 30 * time.Second,
+}
+
+// DialContext dials the resolved address of a host:port if
+// one was given; otherwise the host:port itself.
+func (r Resolves) DialContext(ctx context.Context, network string, addr string) (net.Conn, error) {
+	if a, ok := r[strings.ToLower(addr)]; ok {
+		addr = a
+	}
+	return dialer.DialContext(ctx, network, addr)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestNewProxy(t *testing.T) {
+	if fn, err := NewProxy("", "localhost"); fn != nil || err != nil {
+		t.Errorf("no proxy returned a proxy function, %v", err)
+	}
+	if _, err := NewProxy("ftp://proxy.txstate.edu", ""); err != (ErrProxyScheme{scheme: "ftp"}) {
+		t.Errorf("ftp proxy: %v, want ErrProxyScheme", err)
+	}
+	for _, proxy := range []string{"http://gato-public.its.txstate.edu", "https://proxy.txstate.edu:8443", "socks5://localhost:1080"} {
+		fn, err := NewProxy(proxy, "")
+		if err != nil {
+			t.Fatalf("%s: %v", proxy, err)
+		}
+		req, _ := http.NewRequest("GET", "https://www.txstate.edu/", nil)
+		if u, err := fn(req); err != nil || u == nil || u.String() != proxy {
+			t.Errorf("%s: proxied through %v, %v", proxy, u, err)
+		}
+	}
+}
+
+// No-proxy entries match their host and its subdomains,
+// ignoring case and a leading dot.
+func TestNewProxyNoProxy(t *testing.T) {
+	fn, err := NewProxy("http://gato-public.its.txstate.edu", " .its.txstate.edu, LOCALHOST,,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rawurl, direct := range map[string]bool{
+		"https://its.txstate.edu/":                           true,
+		"https://gato-staging-mainsite2012.its.txstate.edu/": true,
+		"http://localhost:8080/":                             true,
+		"http://Localhost/":                                  true,
+		"https://www.txstate.edu/":                           false,
+		"https://notits.txstate.edu/":                        false,
+		"https://its.txstate.edu.example.com/":               false,
+	} {
+		req, _ := http.NewRequest("GET", rawurl, nil)
+		if u, _ := fn(req); (u == nil) != direct {
+			t.Errorf("%s: proxied through %v, want direct %t", rawurl, u, direct)
+		}
+	}
+	all, err := NewProxy("http://gato-public.its.txstate.edu", "*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest("GET", "https://www.txstate.edu/", nil)
+	if u, _ := all(req); u != nil {
+		t.Errorf("no-proxy * proxied through %v", u)
+	}
+}
+
+// Requests are sent to an http proxy with their absolute url.
+func TestNewProxyRequest(t *testing.T) {
+	var got string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.URL.String()
+		fmt.Fprint(w, "proxied")
+	}))
+	defer proxy.Close()
+	fn, err := NewProxy(proxy.URL, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := Envs{proxy: fn}.NewClient().Get("http://www.txstate.edu/about")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if string(body) != "proxied" || got != "http://www.txstate.edu/about" {
+		t.Errorf("proxy received %q and answered %q", got, body)
+	}
+}
+
+func TestResolvesSet(t *testing.T) {
+	r := Resolves{}
+	for entry, want := range map[string][2]string{
+		"www.txstate.edu:443:10.1.2.3": {"www.txstate.edu:443", "10.1.2.3:443"},
+		"GATO.txstate.edu:80:[::1]":    {"gato.txstate.edu:80", "[::1]:80"},
+		"ipv6.txstate.edu:8080:::1":    {"ipv6.txstate.edu:8080", "[::1]:8080"},
+	} {
+		if err := r.Set(entry); err != nil {
+			t.Errorf("%s: %v", entry, err)
+		} else if r[want[0]] != want[1] {
+			t.Errorf("%s: %s dials %q, want %q", entry, want[0], r[want[0]], want[1])
+		}
+	}
+	if len(r) != 3 {
+		t.Errorf("resolves %v, want 3 entries", r)
+	}
+	for _, entry := range []string{"www.txstate.edu:443", ":443:10.1.2.3", "www.txstate.edu::10.1.2.3", "www.txstate.edu:443:", ""} {
+		if err := r.Set(entry); err != (ErrResolve{entry: entry}) {
+			t.Errorf("%q: %v, want ErrResolve", entry, err)
+		}
+	}
+}
+
+// A resolved host is dialed at its pinned address, while its
+// Host header and TLS SNI still use the url's host.
+func TestResolvesDialContext(t *testing.T) {
+	var host, sni string
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host = r.Host
+		sni = r.TLS.ServerName
+	}))
+	defer ts.Close()
+	_, port, err := net.SplitHostPort(ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := Resolves{}
+	if err := r.Set("www.txstate.edu:" + port + ":127.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	envs := Envs{resolve: r, tlsconf: &tls.Config{InsecureSkipVerify: true}}
+	u := url.URL{Scheme: "https", Host: "www.txstate.edu:" + port, Path: "/"}
+	res, err := envs.NewClient().Get(u.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if host != u.Host || sni != "www.txstate.edu" {
+		t.Errorf("Host %q and SNI %q, want %q and www.txstate.edu", host, sni, u.Host)
+	}
+	// Unresolved hosts are dialed as is.
+	if _, err := envs.NewClient().Get("https://unresolved.invalid:" + port + "/"); err == nil {
+		t.Errorf("unresolved host was dialed")
+	}
+}
@@ -0,0 +1,127 @@
+// Crawl depth, page count and scope budgets (scope)
+package main
+
+import (
+	log "gopkg.in/inconshreveable/log15.v2"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type ScopeBudget struct {
+	prefix string
+	limit  int
+}
+
+// ScopeBudgets limit the number of html pages crawled of a host,
+// or of urls starting with a prefix. They are declared in the
+// [scope] section of the config file as tab delimited host or
+// url prefix and page limit entries:
+//   gato-staging-docs.its.txstate.edu	500
+//   http://gato-staging-testingsite.its.txstate.edu/news/	100
+type ScopeBudgets []ScopeBudget
+
+func (sbs *ScopeBudgets) Parse(fields []string) error {
+	if len(fields) != 2 || fields[0] == "" {
+		return ErrConfigFile{line: strings.Join(fields, "\t")}
+	}
+	limit, err := strconv.Atoi(fields[1])
+	if err != nil || limit < 0 {
+		return ErrConfigFile{line: strings.Join(fields, "\t")}
+	}
+	*sbs = append(*sbs, ScopeBudget{prefix: fields[0], limit: limit})
+	return nil
+}
+
+// Scopes decides which html pages are crawled for links. Pages
+// more than maxdepth link hops from a seed, beyond the first
+// maxpages pages, or beyond a scope budget are cut; i.e. they
+// are only checked to exist, the same as pages found when not
+// crawling. It is shared by all threads; a nil Scopes cuts
+// nothing.
+type Scopes struct {
+	mu       sync.Mutex
+	maxdepth int
+	maxpages int
+	pages    int
+	budgets  ScopeBudgets
+	counts   []int
+	cuts     map[string]int
+}
+
+// NewScopes returns nil if there are no limits; a negative
+// maxdepth and zero maxpages mean no limit.
+func NewScopes(maxdepth int, maxpages int, budgets ScopeBudgets) *Scopes {
+	if maxdepth < 0 && maxpages <= 0 && len(budgets) == 0 {
+		return nil
+	}
+	return &Scopes{maxdepth: maxdepth, maxpages: maxpages, budgets: budgets, counts: make([]int, len(budgets)), cuts: make(map[string]int)}
+}
+
+func (sb ScopeBudget) match(li LinkInfo) bool {
+	if strings.Contains(sb.prefix, "://") {
+		return strings.HasPrefix(li.String(), sb.prefix)
+	}
+	return strings.EqualFold(li.Host, sb.prefix)
+}
+
+// Admit counts an html page about to be crawled against the
+// limits; or returns the reason, and budget rule, it is cut.
+func (s *Scopes) Admit(li LinkInfo, depth int) (string, string) {
+	if s == nil {
+		return "", ""
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	reason, rule := "", ""
+	if s.maxdepth >= 0 && depth > s.maxdepth {
+		reason = "max-depth"
+	} else if s.maxpages > 0 && s.pages >= s.maxpages {
+		reason = "max-pages"
+	} else {
+		for i, sb := range s.budgets {
+			if sb.match(li) && s.counts[i] >= sb.limit {
+				reason, rule = "host-budget", sb.prefix
+				if strings.Contains(sb.prefix, "://") {
+					reason = "path-budget"
+				}
+				break
+			}
+		}
+	}
+	if reason != "" {
+		s.cuts[reason]++
+		return reason, rule
+	}
+	s.pages++
+	for i, sb := range s.budgets {
+		if sb.match(li) {
+			s.counts[i]++
+		}
+	}
+	return "", ""
+}
+
+// Report logs a partial entry, with the number of pages
+// cut for each reason, if the crawl was cut short.
+func (s *Scopes) Report(l log.Logger) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.cuts) == 0 {
+		return
+	}
+	var reasons []string
+	for reason := range s.cuts {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	ctx := []interface{}{"pages", s.pages}
+	for _, reason := range reasons {
+		ctx = append(ctx, reason, s.cuts[reason])
+	}
+	l.Warn("partial", ctx...)
+}
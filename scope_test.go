@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestScopeBudgetsParse(t *testing.T) {
+	for _, test := range []struct {
+		line string
+		want ScopeBudget
+		err  bool
+	}{
+		{"gato-staging-docs.its.txstate.edu\t500", ScopeBudget{prefix: "gato-staging-docs.its.txstate.edu", limit: 500}, false},
+		{"http://www.txstate.edu/news/\t0", ScopeBudget{prefix: "http://www.txstate.edu/news/", limit: 0}, false},
+		{"www.txstate.edu\t-1", ScopeBudget{}, true},
+		{"www.txstate.edu\t1K", ScopeBudget{}, true},
+		{"\t100", ScopeBudget{}, true},
+		{"www.txstate.edu", ScopeBudget{}, true},
+	} {
+		var sbs ScopeBudgets
+		err := sbs.Parse(strings.Split(test.line, "\t"))
+		if (err != nil) != test.err {
+			t.Errorf("%q: error %v, want error %t", test.line, err, test.err)
+		} else if err == nil && (len(sbs) != 1 || sbs[0] != test.want) {
+			t.Errorf("%q: budgets %v, want %v", test.line, sbs, test.want)
+		}
+	}
+}
+
+// Without limits, no pages are counted or cut.
+func TestScopesNil(t *testing.T) {
+	s := NewScopes(-1, 0, nil)
+	if s != nil {
+		t.Fatalf("NewScopes(-1, 0, nil) = %v, want nil", s)
+	}
+	if reason, rule := s.Admit(LinkInfo{}, 100); reason != "" || rule != "" {
+		t.Errorf("nil Scopes cut a page: %s %s", reason, rule)
+	}
+	s.Report(discardLog())
+}
+
+// scopeSite serves a site whose home page links to /a, which
+// links to /b, and to three /news/ pages; recording the method
+// and path of each request.
+func scopeSite() (*httptest.Server, func() []string) {
+	var mu sync.Mutex
+	var requests []string
+	links := map[string]string{
+		"/":  `<a href="/a">a</a><a href="/news/1">1</a><a href="/news/2">2</a><a href="/news/3">3</a>`,
+		"/a": `<a href="/b">b</a>`,
+		"/b": `<a href="/c">c</a>`,
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		mu.Unlock()
+		w.Header().Set("Content-Type", "text/html")
+		if r.Method != "HEAD" {
+			fmt.Fprint(w, "<html><body>"+links[r.URL.Path]+"</body></html>")
+		}
+	}))
+	return ts, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		sorted := append([]string(nil), requests...)
+		sort.Strings(sorted)
+		return sorted
+	}
+}
+
+// Pages cut by a depth, page count or scope budget are logged
+// with the reason, and only checked to exist by a HEAD request;
+// the crawl's report then logs it was partial.
+func TestScopesCrawl(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		maxdepth int
+		maxpages int
+		budgets  func(ts *httptest.Server) ScopeBudgets
+		cut      []string // path reason rule depth
+		gets     int
+	}{
+		{
+			name:     "max-depth",
+			maxdepth: 1,
+			cut:      []string{"/b max-depth  2"},
+			gets:     5,
+		},
+		{
+			name:     "max-pages",
+			maxdepth: -1,
+			maxpages: 1,
+			cut:      []string{"/a max-pages  1", "/news/1 max-pages  1", "/news/2 max-pages  1", "/news/3 max-pages  1"},
+			gets:     1,
+		},
+		{
+			name:     "host-budget",
+			maxdepth: -1,
+			budgets: func(ts *httptest.Server) ScopeBudgets {
+				return ScopeBudgets{{prefix: ts.Listener.Addr().String(), limit: 1}}
+			},
+			cut:  []string{"/a host-budget HOST 1", "/news/1 host-budget HOST 1", "/news/2 host-budget HOST 1", "/news/3 host-budget HOST 1"},
+			gets: 1,
+		},
+		{
+			name:     "path-budget",
+			maxdepth: -1,
+			budgets: func(ts *httptest.Server) ScopeBudgets {
+				return ScopeBudgets{{prefix: ts.URL + "/news/", limit: 0}}
+			},
+			cut:  []string{"/news/1 path-budget URL/news/ 1", "/news/2 path-budget URL/news/ 1", "/news/3 path-budget URL/news/ 1"},
+			gets: 4,
+		},
+	} {
+		ts, requests := scopeSite()
+		host := ts.Listener.Addr().String()
+		envs := testEnvs(t, regexp.QuoteMeta(ts.URL))
+		var budgets ScopeBudgets
+		if test.budgets != nil {
+			budgets = test.budgets(ts)
+		}
+		envs.scopes = NewScopes(test.maxdepth, test.maxpages, budgets)
+		tl := testCrawl(envs, 1, ts.URL+"/")
+		ts.Close()
+
+		var cut []string
+		for _, ctx := range tl.find("cut") {
+			rule := strings.Replace(fmt.Sprint(ctx["rule"]), ts.URL, "URL", 1)
+			rule = strings.Replace(rule, host, "HOST", 1)
+			cut = append(cut, fmt.Sprintf("%s %v %s %v", strings.TrimPrefix(fmt.Sprint(ctx["url"]), ts.URL), ctx["reason"], rule, ctx["depth"]))
+		}
+		sort.Strings(cut)
+		if fmt.Sprint(cut) != fmt.Sprint(test.cut) {
+			t.Errorf("%s: cut %q, want %q", test.name, cut, test.cut)
+		}
+		gets, heads := 0, make(map[string]bool)
+		for _, r := range requests() {
+			if strings.HasPrefix(r, "GET ") {
+				gets++
+			} else {
+				heads[strings.TrimPrefix(r, "HEAD ")] = true
+			}
+		}
+		if gets != test.gets {
+			t.Errorf("%s: %d pages crawled, want %d: %v", test.name, gets, test.gets, requests())
+		}
+		for _, c := range test.cut {
+			if path := strings.Fields(c)[0]; !heads[path] {
+				t.Errorf("%s: cut page %s not checked to exist: %v", test.name, path, requests())
+			}
+		}
+
+		tl = &testLog{}
+		envs.scopes.Report(tl.logger())
+		partial := tl.find("partial")
+		if len(partial) != 1 || partial[0]["pages"] != test.gets || partial[0][test.name] != len(test.cut) {
+			t.Errorf("%s: partial %v, want %d pages and %d cut", test.name, partial, test.gets, len(test.cut))
+		}
+	}
+}
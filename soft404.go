@@ -0,0 +1,152 @@
+// Soft 404 page detection (soft404)
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	log "gopkg.in/inconshreveable/log15.v2"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+type ErrSoft404 struct {
+	rule string
+}
+
+func (e ErrSoft404) Error() string {
+	return fmt.Sprintf("Soft 404 page matched rule '%s'", e.rule)
+}
+
+// Soft404 holds the fingerprints of "page not found"
+// content served with a 200 status. Fingerprints are
+// declared in the [soft404] section of the config file:
+//   # Page title regular expression
+//   title	^Page Not Found
+//   # Page body regular expression
+//   body	<div class="error-404">
+//   # Path prefix of a page guaranteed not to exist; a
+//   # random string is appended and requested from each
+//   # seed host at startup to learn its error page hash.
+//   probe	/thrawler-soft-404-
+type Soft404 struct {
+	titles []*regexp.Regexp
+	bodies []*regexp.Regexp
+	probe  string
+	hashes map[string]string
+}
+
+func (s *Soft404) Parse(fields []string) error {
+	if len(fields) != 2 {
+		return ErrConfigFile{line: strings.Join(fields, "\t")}
+	}
+	switch fields[0] {
+	case "title":
+		re, err := regexp.Compile(fields[1])
+		if err != nil {
+			return err
+		}
+		s.titles = append(s.titles, re)
+	case "body":
+		re, err := regexp.Compile(fields[1])
+		if err != nil {
+			return err
+		}
+		s.bodies = append(s.bodies, re)
+	case "probe":
+		if !strings.HasPrefix(fields[1], "/") {
+			return ErrConfigFile{line: strings.Join(fields, "\t")}
+		}
+		s.probe = fields[1]
+		s.hashes = make(map[string]string)
+	default:
+		return ErrConfigFile{line: strings.Join(fields, "\t")}
+	}
+	return nil
+}
+
+// Learn requests a page guaranteed not to exist from each
+// seed host and records the hash of the returned error page.
+// Learn must be called before crawling starts, as the learned
+// hashes are shared by all threads without locking.
+func (s Soft404) Learn(l log.Logger, envs Envs, urls []string) {
+	if s.probe == "" {
+		return
+	}
+	for _, seed := range urls {
+		url, profile := splitSeed(seed)
+		li, err := envs.canon(LinkInfo{}, url)
+		if err != nil {
+			continue
+		}
+		host := li.Protocol + "://" + li.Host
+		if _, ok := s.hashes[host]; ok {
+			continue
+		}
+		path := s.probe + randomString()
+		req, err := http.NewRequest("GET", host+path, nil)
+		if err != nil {
+			l.Warn("soft-404-probe", "url", host+path, "err", err.Error())
+			continue
+		}
+		envs.headers.Add(req, profile, "")
+		res, err := envs.NewClient().Do(req)
+		if err != nil {
+			if res != nil {
+				res.Body.Close()
+			}
+			l.Warn("soft-404-probe", "url", host+path, "err", err.Error())
+			continue
+		}
+		body, _, _, err := envs.bodies.Read(res)
+		res.Body.Close()
+		if err != nil {
+			l.Warn("soft-404-probe", "url", host+path, "err", err.Error())
+			continue
+		}
+		s.hashes[host] = pageHash(body, path)
+		l.Debug("soft-404-probe", "url", host+path, "code", res.StatusCode, "hash", s.hashes[host])
+	}
+}
+
+// Match returns the name of the first soft 404 rule matched by
+// a page's title or body; or an empty string if none match.
+func (s Soft404) Match(li LinkInfo, title string, body []byte) string {
+	for _, re := range s.titles {
+		if re.MatchString(title) {
+			return "title:" + re.String()
+		}
+	}
+	for _, re := range s.bodies {
+		if re.Match(body) {
+			return "body:" + re.String()
+		}
+	}
+	if hash, ok := s.hashes[li.Protocol+"://"+li.Host]; ok {
+		if hash == pageHash(body, li.Path) {
+			return "probe:" + li.Protocol + "://" + li.Host + s.probe
+		}
+	}
+	return ""
+}
+
+// pageHash returns the hex encoded sha1 hash of a page body
+// with all occurrences of the page's own path removed; as
+// error pages commonly echo back the requested path.
+func pageHash(body []byte, path string) string {
+	h := sha1.New()
+	if path != "" && path != "/" {
+		h.Write([]byte(strings.Replace(string(body), path, "", -1)))
+	} else {
+		h.Write(body)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func randomString() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+)
+
+// testSoft404 returns the Soft404 of [soft404] entries.
+func testSoft404(t *testing.T, entries ...[]string) Soft404 {
+	var s Soft404
+	for _, fields := range entries {
+		if err := s.Parse(fields); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return s
+}
+
+func TestSoft404Match(t *testing.T) {
+	s := testSoft404(t, []string{"title", "^Page Not Found"}, []string{"body", `<div class="error-404">`})
+	li := LinkInfo{Protocol: "https", Host: "www.txstate.edu", Path: "/gone"}
+	tests := []struct {
+		title string
+		body  string
+		rule  string
+	}{
+		{"Page Not Found | Texas State", "", "title:^Page Not Found"},
+		{"Texas State | Page Not Found", "", ""},
+		{"Oops", `<main><div class="error-404">Gone</div></main>`, `body:<div class="error-404">`},
+		{"Page Not Found", `<div class="error-404">`, "title:^Page Not Found"},
+		{"About", "<p>About us</p>", ""},
+	}
+	for _, test := range tests {
+		if rule := s.Match(li, test.title, []byte(test.body)); rule != test.rule {
+			t.Errorf("Match(%q, %q) = %q, want %q", test.title, test.body, rule, test.rule)
+		}
+	}
+}
+
+func TestSoft404Parse(t *testing.T) {
+	for _, fields := range [][]string{
+		{"title"},
+		{"title", "(unclosed"},
+		{"probe", "no-slash-"},
+		{"status", "200"},
+	} {
+		var s Soft404
+		if err := s.Parse(fields); err == nil {
+			t.Errorf("Parse(%q) accepted", fields)
+		}
+	}
+}
+
+// errorSite serves an error page echoing the requested path,
+// with a 200 status, for every path but the home page; and
+// counts the requests of each path.
+func errorSite(name string, requests map[string]int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests[r.URL.Path]++
+		w.Header().Set("Content-Type", "text/html")
+		if r.URL.Path == "/" {
+			fmt.Fprint(w, `<html><head><title>Home</title></head><body><a href="/gone">Gone</a></body></html>`)
+			return
+		}
+		fmt.Fprintf(w, `<html><head><title>%s</title></head><body>No page at %s</body></html>`, name, r.URL.Path)
+	}))
+}
+
+// Each seed host's error page is learned once, and pages
+// matching it on that host only are soft 404s.
+func TestSoft404Learn(t *testing.T) {
+	requests := make(map[string]int)
+	a := errorSite("Site A", requests)
+	defer a.Close()
+	b := errorSite("Site B", requests)
+	defer b.Close()
+	envs := testEnvs(t, ".")
+	s := testSoft404(t, []string{"probe", "/thrawler-soft-404-"})
+	s.Learn(discardLog(), envs, []string{a.URL + "/", a.URL + "/about", b.URL + "/"})
+	if len(s.hashes) != 2 {
+		t.Fatalf("learned %d hosts, want 2", len(s.hashes))
+	}
+	probes := 0
+	for path, n := range requests {
+		if regexp.MustCompile(`^/thrawler-soft-404-[0-9a-f]{32}$`).MatchString(path) {
+			probes += n
+		}
+	}
+	if probes != 2 || len(requests) != 2 {
+		t.Errorf("requested %v, want one probe of each host", requests)
+	}
+	for _, test := range []struct {
+		url  string
+		body string
+		rule string
+	}{
+		{a.URL + "/gone", "<html><head><title>Site A</title></head><body>No page at /gone</body></html>", "probe:" + a.URL + "/thrawler-soft-404-"},
+		{b.URL + "/gone", "<html><head><title>Site A</title></head><body>No page at /gone</body></html>", ""},
+		{a.URL + "/about", "<html><head><title>About</title></head><body>About us</body></html>", ""},
+	} {
+		li, err := envs.canon(LinkInfo{}, test.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rule := s.Match(li, "", []byte(test.body)); rule != test.rule {
+			t.Errorf("Match(%s) = %q, want %q", test.url, rule, test.rule)
+		}
+	}
+}
+
+// Soft 404 pages are logged with the rule matched, and their
+// links are not crawled.
+func TestSoft404Crawl(t *testing.T) {
+	requests := make(map[string]int)
+	ts := errorSite("Page Not Found", requests)
+	defer ts.Close()
+	envs := testEnvs(t, "^"+regexp.QuoteMeta(ts.URL)+"($|/)")
+	envs.soft404 = testSoft404(t, []string{"title", "^Page Not Found"})
+	tl := testCrawl(envs, 1, ts.URL+"/")
+	found := tl.find("soft-404")
+	if len(found) != 1 || found[0]["url"] != ts.URL+"/gone" || found[0]["rule"] != "title:^Page Not Found" || found[0]["src"] != ts.URL+"/" {
+		t.Errorf("soft-404 entries %v", found)
+	}
+	for _, ctx := range tl.find("req") {
+		if ctx["url"] == ts.URL+"/gone" && ctx["err"] != (ErrSoft404{rule: "title:^Page Not Found"}).Error() {
+			t.Errorf("req %v", ctx)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+// Disk spill of the crawl frontier (spill)
+package main
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+)
+
+// spillQueue is a first in, first out queue of records in a
+// temporary file; each record prefixed by its varint length.
+// The file is created on the first push and truncated
+// whenever the queue is emptied. It is not safe for
+// concurrent use.
+type spillQueue struct {
+	dir  string
+	f    *os.File
+	roff int64
+	woff int64
+	n    int
+}
+
+func (q *spillQueue) push(b []byte) error {
+	if q.f == nil {
+		f, err := ioutil.TempFile(q.dir, "thrawler-frontier-")
+		if err != nil {
+			return err
+		}
+		q.f = f
+	}
+	rec := make([]byte, binary.MaxVarintLen64+len(b))
+	n := binary.PutUvarint(rec, uint64(len(b)))
+	n += copy(rec[n:], b)
+	if _, err := q.f.WriteAt(rec[:n], q.woff); err != nil {
+		return err
+	}
+	q.woff += int64(n)
+	q.n++
+	return nil
+}
+
+// pop removes the first record; even if it can not be read,
+// so that a corrupt record does not block the queue.
+func (q *spillQueue) pop() ([]byte, error) {
+	q.n--
+	defer func() {
+		if q.n == 0 {
+			q.roff, q.woff = 0, 0
+			q.f.Truncate(0)
+		}
+	}()
+	head := make([]byte, binary.MaxVarintLen64)
+	n, err := q.f.ReadAt(head, q.roff)
+	if n == 0 {
+		return nil, err
+	}
+	size, hn := binary.Uvarint(head[:n])
+	b := make([]byte, size)
+	if _, err := q.f.ReadAt(b, q.roff+int64(hn)); err != nil {
+		return nil, err
+	}
+	q.roff += int64(hn) + int64(size)
+	return b, nil
+}
+
+// close removes the queue's temporary file.
+func (q *spillQueue) close() {
+	if q.f != nil {
+		q.f.Close()
+		os.Remove(q.f.Name())
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestSpillQueue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "thrawler-spill-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	q := &spillQueue{dir: dir}
+	record := func(i int) []byte {
+		return bytes.Repeat([]byte(fmt.Sprintf("%d,", i)), i*37)
+	}
+	// Interleave pushes and pops, emptying the queue twice.
+	next := 0
+	for round, pushes := range []int{10, 200, 1} {
+		for i := 0; i < pushes; i++ {
+			if err := q.push(record(next + i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for i := 0; i < pushes; i++ {
+			b, err := q.pop()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(b, record(next+i)) {
+				t.Fatalf("round %d: record %d popped %d bytes, want %d", round, next+i, len(b), len(record(next+i)))
+			}
+		}
+		next += pushes
+		if info, err := q.f.Stat(); err != nil || info.Size() != 0 || q.n != 0 {
+			t.Errorf("round %d: emptied queue of %d records not truncated", round, q.n)
+		}
+	}
+	name := q.f.Name()
+	q.close()
+	if _, err := os.Stat(name); !os.IsNotExist(err) {
+		t.Errorf("spill file %s not removed", name)
+	}
+}
+
+func TestEnvsSpill(t *testing.T) {
+	envs := testEnvs(t, ".")
+	li, err := envs.canon(LinkInfo{}, "https://www.txstate.edu/news/index.html?page=2#top")
+	if err != nil {
+		t.Fatal(err)
+	}
+	li.Tag, li.Kind = "html/body/a(href)", "a(href)"
+	linked := envs
+	linked.profile = "author"
+	for _, pi := range []ProcInfo{
+		HtmlFilterLink{LinkInfo: li, Envs: linked, source: "https://www.txstate.edu/", depth: 3},
+		CssFilterLink{LinkInfo: li, Envs: envs, source: "https://www.txstate.edu/", attempt: 1},
+		ExistOnlyLink{LinkInfo: li, Envs: linked, attempt: 2, depth: 1},
+	} {
+		b, err := envs.Encode(pi)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := envs.Decode(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprintf("%T", decoded) != fmt.Sprintf("%T", pi) || spillFields(decoded) != spillFields(pi) {
+			t.Errorf("decoded %T %s, want %T %s", decoded, spillFields(decoded), pi, spillFields(pi))
+		}
+	}
+	if _, err := envs.Encode(DelayedProc{ProcInfo: ExistOnlyLink{LinkInfo: li, Envs: envs}}); err == nil {
+		t.Error("encoded a DelayedProc")
+	}
+	if _, err := envs.Decode([]byte("{")); err == nil {
+		t.Error("decoded a corrupt record")
+	}
+}
+
+// spillFields describes the fields of a link kept when spilled.
+func spillFields(pi ProcInfo) string {
+	switch link := pi.(type) {
+	case HtmlFilterLink:
+		return fmt.Sprintf("%+v %s %d %d %s", link.LinkInfo, link.source, link.attempt, link.depth, link.profile)
+	case CssFilterLink:
+		return fmt.Sprintf("%+v %s %d %d %s", link.LinkInfo, link.source, link.attempt, link.depth, link.profile)
+	case ExistOnlyLink:
+		return fmt.Sprintf("%+v %s %d %d %s", link.LinkInfo, link.source, link.attempt, link.depth, link.profile)
+	}
+	return ""
+}
+
+// A crawl with a frontier of one link spills, and reads back,
+// all the links found; each being requested once.
+func TestSpillCrawl(t *testing.T) {
+	dir, err := ioutil.TempDir("", "thrawler-spill-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	requests := make(chan string, 100)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- r.Method + " " + r.URL.Path
+		w.Header().Set("Content-Type", "text/html")
+		if r.URL.Path == "/" {
+			for i := 0; i < 20; i++ {
+				fmt.Fprintf(w, `<a href="/page%d">page</a><img src="/img%d.png">`, i, i)
+			}
+		}
+	}))
+	defer ts.Close()
+	envs := testEnvs(t, regexp.QuoteMeta(ts.URL))
+	pis := StartHtmlFilterLinks(envs, []string{ts.URL + "/"})
+	tl := &testLog{}
+	Run(tl.logger(), 2, Frontier{Max: 1, Dir: dir, Spiller: envs, Progress: time.Millisecond}, pis)
+	close(requests)
+	seen := make(map[string]int)
+	for r := range requests {
+		seen[r]++
+	}
+	if len(seen) != 41 {
+		t.Errorf("%d distinct requests, want 41", len(seen))
+	}
+	for r, n := range seen {
+		if n != 1 {
+			t.Errorf("%s requested %d times", r, n)
+		}
+	}
+	if entries := tl.find("spill"); len(entries) != 0 {
+		t.Errorf("spill errors %v", entries)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Errorf("%d spill files left in %s", len(files), dir)
+	}
+}
@@ -0,0 +1,225 @@
+// Visited url status stores (store)
+package main
+
+import (
+	"hash/fnv"
+	"strings"
+	"sync"
+)
+
+type ErrVisitedStore struct {
+	spec string
+}
+
+func (e ErrVisitedStore) Error() string {
+	return "Visited store must be map, hash or disk:path, optionally prefixed by bloom: '" + e.spec + "'"
+}
+
+// VisitedStore holds the status code of each visited url. A
+// store must be safe for concurrent use by all threads.
+type VisitedStore interface {
+	Get(url string) (int, bool)
+	Put(url string, stat int) error
+	Close() error
+}
+
+// NewVisitedStore returns the store named by spec:
+//   map	every url string in memory
+//   hash	compact table of 64 bit url hashes
+//   disk:path	on-disk key value store kept after the crawl
+// Any of which may be prefixed by bloom:, fronting the store
+// with a bloom filter; e.g. bloom:disk:path.
+func NewVisitedStore(spec string) (VisitedStore, error) {
+	switch {
+	case strings.HasPrefix(spec, "bloom:") && len(spec) > 6 && !strings.HasPrefix(spec, "bloom:bloom:"):
+		store, err := NewVisitedStore(spec[6:])
+		if _, ok := err.(ErrVisitedStore); ok {
+			return nil, ErrVisitedStore{spec: spec}
+		} else if err != nil {
+			return nil, err
+		}
+		return &bloomStore{VisitedStore: store, bloom: newBloom(bloomBits, bloomHashes)}, nil
+	case spec == "" || spec == "map":
+		return &mapStore{statuses: make(map[string]int)}, nil
+	case spec == "hash":
+		return &hashStore{}, nil
+	case strings.HasPrefix(spec, "disk:") && len(spec) > 5:
+		return OpenDiskStore(spec[5:], true)
+	}
+	return nil, ErrVisitedStore{spec: spec}
+}
+
+// mapStore keeps every url string; exact, but the
+// memory used grows with the length of the urls.
+type mapStore struct {
+	mu       sync.Mutex
+	statuses map[string]int
+}
+
+func (s *mapStore) Get(url string) (int, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stat, ok := s.statuses[url]
+	return stat, ok
+}
+
+func (s *mapStore) Put(url string, stat int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.statuses[url] = stat
+	return nil
+}
+
+func (s *mapStore) Close() error {
+	return nil
+}
+
+func urlHash(url string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(url))
+	return h.Sum64()
+}
+
+// hashStore is an open addressing table of 64 bit url hashes
+// and 16 bit status codes; 10 bytes per table slot whatever
+// the length of the url. Two urls sharing a hash, about one
+// chance in 2^64 per pair, are mistaken for one another.
+type hashStore struct {
+	mu    sync.Mutex
+	keys  []uint64
+	stats []int16
+	n     int
+}
+
+// slot returns the table index of a hash; either holding
+// the hash or the empty slot it would be stored in. Zero
+// marks empty slots; so hashes of zero are stored as one.
+func (s *hashStore) slot(h uint64) int {
+	mask := uint64(len(s.keys) - 1)
+	for i := h & mask; ; i = (i + 1) & mask {
+		if s.keys[i] == h || s.keys[i] == 0 {
+			return int(i)
+		}
+	}
+}
+
+func nonzero(h uint64) uint64 {
+	if h == 0 {
+		return 1
+	}
+	return h
+}
+
+func (s *hashStore) Get(url string) (int, bool) {
+	h := nonzero(urlHash(url))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.n == 0 {
+		return 0, false
+	}
+	i := s.slot(h)
+	if s.keys[i] == 0 {
+		return 0, false
+	}
+	return int(s.stats[i]), true
+}
+
+func (s *hashStore) Put(url string, stat int) error {
+	h := nonzero(urlHash(url))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Grow the table at three quarters full.
+	if (s.n+1)*4 > len(s.keys)*3 {
+		keys, stats := s.keys, s.stats
+		size := len(keys) * 2
+		if size == 0 {
+			size = 1024
+		}
+		s.keys, s.stats = make([]uint64, size), make([]int16, size)
+		for j, k := range keys {
+			if k != 0 {
+				i := s.slot(k)
+				s.keys[i], s.stats[i] = k, stats[j]
+			}
+		}
+	}
+	i := s.slot(h)
+	if s.keys[i] == 0 {
+		s.keys[i] = h
+		s.n++
+	}
+	s.stats[i] = int16(stat)
+	return nil
+}
+
+func (s *hashStore) Close() error {
+	return nil
+}
+
+// Size of the bloom filter fronting a bloom: store; 16M bits
+// (2MB) with 7 hashes has a 1% false positive rate at about
+// 1.7M urls. Beyond that the filter lets more lookups through
+// to the store, without affecting the results.
+const bloomBits = 1 << 24
+const bloomHashes = 7
+
+// bloomStore fronts a store with a bloom filter; so lookups
+// of unvisited urls, most of those made while crawling, are
+// answered without waiting on the store's lock; e.g. while
+// a disk store writes a record.
+type bloomStore struct {
+	VisitedStore
+	mu    sync.RWMutex
+	bloom *bloom
+}
+
+func (s *bloomStore) Get(url string) (int, bool) {
+	s.mu.RLock()
+	has := s.bloom.has(urlHash(url))
+	s.mu.RUnlock()
+	if !has {
+		return 0, false
+	}
+	return s.VisitedStore.Get(url)
+}
+
+// Put adds the url to the filter first; so a url is never
+// in the store but missing from the filter.
+func (s *bloomStore) Put(url string, stat int) error {
+	s.mu.Lock()
+	s.bloom.add(urlHash(url))
+	s.mu.Unlock()
+	return s.VisitedStore.Put(url, stat)
+}
+
+type bloom struct {
+	bits []uint64
+	k    uint64
+}
+
+func newBloom(m int, k int) *bloom {
+	return &bloom{bits: make([]uint64, m/64), k: uint64(k)}
+}
+
+// Bit positions are derived from the two halves of the
+// url hash by double hashing.
+func (b *bloom) add(h uint64) {
+	m := uint64(len(b.bits) * 64)
+	h1, h2 := h&0xffffffff, h>>32|1
+	for i := uint64(0); i < b.k; i++ {
+		bit := (h1 + i*h2) % m
+		b.bits[bit/64] |= 1 << (bit % 64)
+	}
+}
+
+func (b *bloom) has(h uint64) bool {
+	m := uint64(len(b.bits) * 64)
+	h1, h2 := h&0xffffffff, h>>32|1
+	for i := uint64(0); i < b.k; i++ {
+		bit := (h1 + i*h2) % m
+		if b.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
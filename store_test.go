@@ -0,0 +1,234 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Colliding hashes probe to the next free slot, wrapping
+// around the end of the table.
+func TestHashStoreSlot(t *testing.T) {
+	s := &hashStore{keys: make([]uint64, 8), stats: make([]int16, 8)}
+	s.keys[3], s.keys[7] = 3, 7
+	for _, c := range []struct {
+		h    uint64
+		want int
+	}{{3, 3}, {11, 4}, {7, 7}, {15, 0}, {5, 5}} {
+		if i := s.slot(c.h); i != c.want {
+			t.Errorf("slot(%d) = %d, want %d", c.h, i, c.want)
+		}
+	}
+	if nonzero(0) != 1 || nonzero(2) != 2 {
+		t.Errorf("nonzero(0) = %d, nonzero(2) = %d", nonzero(0), nonzero(2))
+	}
+}
+
+// The table grows past its first 1024 slots without losing
+// statuses, and a url put again keeps one slot.
+func TestHashStoreGrowth(t *testing.T) {
+	s := &hashStore{}
+	for i := 0; i < 3000; i++ {
+		s.Put(fmt.Sprintf("https://www.txstate.edu/%d", i), 200+i%300)
+	}
+	s.Put("https://www.txstate.edu/7", 404)
+	if s.n != 3000 || len(s.keys) != 4096 {
+		t.Errorf("%d urls in %d slots, want 3000 in 4096", s.n, len(s.keys))
+	}
+	for i := 0; i < 3000; i++ {
+		want := 200 + i%300
+		if i == 7 {
+			want = 404
+		}
+		if stat, ok := s.Get(fmt.Sprintf("https://www.txstate.edu/%d", i)); stat != want || !ok {
+			t.Errorf("url %d: %d, %v, want %d", i, stat, ok, want)
+		}
+	}
+	if _, ok := s.Get("https://www.txstate.edu/3000"); ok {
+		t.Error("unvisited url found")
+	}
+}
+
+func TestDiskStoreReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "thrawler-store-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "visited.db")
+	s, err := OpenDiskStore(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Put("https://www.txstate.edu/", -1)
+	s.Put("https://www.txstate.edu/a", 404)
+	s.Put("https://www.txstate.edu/", 200)
+	size := s.size
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Leave a torn record at the end, as a crash would.
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{20, 'h', 't'})
+	f.Close()
+
+	s, err = OpenDiskStore(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, _ := os.Stat(path); s.size != size || info.Size() != size {
+		t.Errorf("size %d, file %d, want %d", s.size, info.Size(), size)
+	}
+	for url, want := range map[string]int{"https://www.txstate.edu/": 200, "https://www.txstate.edu/a": 404} {
+		if stat, ok := s.Get(url); stat != want || !ok {
+			t.Errorf("%s: %d, %v, want %d", url, stat, ok, want)
+		}
+		if n := len(s.index[urlHash(url)]); n != 1 {
+			t.Errorf("%s: %d index offsets, want 1", url, n)
+		}
+	}
+	if _, ok := s.Get("https://www.txstate.edu/b"); ok {
+		t.Error("unvisited url found")
+	}
+	s.Put("https://www.txstate.edu/b", 301)
+	s.Close()
+
+	// Truncating starts a new crawl.
+	s, err = OpenDiskStore(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if _, ok := s.Get("https://www.txstate.edu/b"); ok || len(s.index) != 0 {
+		t.Error("truncated store kept statuses")
+	}
+}
+
+// Records missing their status varint are corrupt, rather
+// than holding a status of 0.
+func TestDiskStoreCorrupt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "thrawler-store-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "visited.db")
+	s, err := OpenDiskStore(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	off := s.size
+	s.f.WriteAt([]byte{3, 'a', 'b', 'c', 0x80}, off)
+	if _, _, err := s.record(off); err == nil {
+		t.Error("record without a status read")
+	}
+	s.f.WriteAt([]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, off)
+	if _, _, err := s.record(off); err == nil {
+		t.Error("record without a length read")
+	}
+
+	if err := ioutil.WriteFile(path+".txt", []byte("not a store\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenDiskStore(path+".txt", false); err == nil {
+		t.Error("opened a file that is not a store")
+	}
+}
+
+func TestNewVisitedStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "thrawler-store-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, test := range []struct {
+		spec string
+		want string
+	}{
+		{"", "*main.mapStore"},
+		{"map", "*main.mapStore"},
+		{"hash", "*main.hashStore"},
+		{"disk:" + filepath.Join(dir, "visited.db"), "*main.DiskStore"},
+		{"bloom:hash", "*main.bloomStore *main.hashStore"},
+		{"bloom:disk:" + filepath.Join(dir, "bloom.db"), "*main.bloomStore *main.DiskStore"},
+		{"bloom", "ErrVisitedStore"},
+		{"bloom:", "ErrVisitedStore"},
+		{"bloom:bloom:hash", "ErrVisitedStore"},
+		{"disk:", "ErrVisitedStore"},
+		{"tree", "ErrVisitedStore"},
+		{"bloom:disk:" + filepath.Join(dir, "missing", "visited.db"), "error"},
+	} {
+		store, err := NewVisitedStore(test.spec)
+		got := fmt.Sprintf("%T", store)
+		if bs, ok := store.(*bloomStore); ok {
+			got += fmt.Sprintf(" %T", bs.VisitedStore)
+		}
+		if _, ok := err.(ErrVisitedStore); ok {
+			got = "ErrVisitedStore"
+		} else if err != nil {
+			got = "error"
+		}
+		if got != test.want {
+			t.Errorf("%q: %s, want %s", test.spec, got, test.want)
+		}
+		if store != nil {
+			store.Close()
+		}
+	}
+}
+
+// countStore counts the lookups reaching a store.
+type countStore struct {
+	VisitedStore
+	gets int
+}
+
+func (s *countStore) Get(url string) (int, bool) {
+	s.gets++
+	return s.VisitedStore.Get(url)
+}
+
+// A bloom filter has no false negatives, and a false positive
+// rate near that expected of its size; so most lookups of
+// unvisited urls never reach the store behind it.
+func TestBloomStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "thrawler-store-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	disk, err := OpenDiskStore(filepath.Join(dir, "visited.db"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer disk.Close()
+	cs := &countStore{VisitedStore: disk}
+	// 2^16 bits and 7 hashes; about a 1% false positive rate
+	// at 6800 urls.
+	s := &bloomStore{VisitedStore: cs, bloom: newBloom(1<<16, 7)}
+	for i := 0; i < 6800; i++ {
+		if err := s.Put(fmt.Sprintf("https://www.txstate.edu/%d", i), 200+i%100); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 6800; i++ {
+		if stat, ok := s.Get(fmt.Sprintf("https://www.txstate.edu/%d", i)); !ok || stat != 200+i%100 {
+			t.Fatalf("url %d: %d, %v; want %d", i, stat, ok, 200+i%100)
+		}
+	}
+	cs.gets = 0
+	for i := 0; i < 10000; i++ {
+		if _, ok := s.Get(fmt.Sprintf("https://www.txstate.edu/never/%d", i)); ok {
+			t.Fatalf("unvisited url %d found", i)
+		}
+	}
+	if cs.gets > 300 {
+		t.Errorf("%d of 10000 lookups of unvisited urls reached the store, want about 100", cs.gets)
+	}
+}
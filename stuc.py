@@ -7,7 +7,7 @@ embedded = {}
 
 for line in sys.stdin:
   data = json.loads(line)
-  if data["lvl"] == 3:
+  if data["lvl"] == 3 and data["msg"] == "req":
     printable = True
     src = data["src"]
     tag = data["tag"]
@@ -18,7 +18,8 @@ for line in sys.stdin:
     #   Calendar events within: /div#aAbBcCdDeE.column_paragraph/div.gato-events/      => tag=gato-events(aAbBcCdDeE)
     #   Twitter feeds within: /div#bBcCdDeEfF.column_paragraph/div.gato-twitter-feed/  => tag=gato-twitter-feed(bBcCdDeEfF)
     #   RSS feed: /div#cCdDeEfFgG.column_paragraph/div.gato-rss-item)/                 => tag=gato-rss-item(cCdDeEfFgG)
-    m = re.match('.*?/div#([a-zA-Z0-9]{8,12})\.column_paragraph/div\.(gato-events|gato-twitter-feed|gato-rss-item)/.*', tag)
+    # NOTE: Optional :nth-child(n) indexes (--nth-child=true) are ignored.
+    m = re.match('.*?/div#([a-zA-Z0-9]{8,12})\.column_paragraph(?::nth-child\(\d+\))?/div\.(gato-events|gato-twitter-feed|gato-rss-item)(?::nth-child\(\d+\))?/.*', tag)
     if m:
       url = ""
       tag = m.group(2)+"("+m.group(1)+")"
@@ -51,6 +52,6 @@ for line in sys.stdin:
       # ending path, as we do NOT care where on the page we found them,
       # but rather what element and it's attribute we found them in.
       tags = tag.split("/")
-      tag = tags[-1]
+      tag = re.sub(':nth-child\(\d+\)', '', tags[-1])
     if printable:
       print(src + "\t" + tag + "\t" + url + "\t" + code)
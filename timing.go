@@ -0,0 +1,237 @@
+// Response timing metrics (timing)
+package main
+
+import (
+	"container/heap"
+	"crypto/tls"
+	log "gopkg.in/inconshreveable/log15.v2"
+	"math"
+	"net/http"
+	"net/http/httptrace"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Timing records when each phase of a request occurred
+// using an httptrace.ClientTrace. Trace hooks may be called
+// from the transport's dialing goroutines; so all access is
+// guarded by a mutex.
+type Timing struct {
+	mu        sync.Mutex
+	start     time.Time
+	dnsStart  time.Time
+	dnsDone   time.Time
+	connStart time.Time
+	connDone  time.Time
+	tlsStart  time.Time
+	tlsDone   time.Time
+	firstByte time.Time
+}
+
+// NewTiming returns a copy of the request that
+// records its phase timings in the returned Timing.
+func NewTiming(req *http.Request) (*http.Request, *Timing) {
+	t := &Timing{start: time.Now()}
+	mark := func(at *time.Time, first bool) {
+		t.mu.Lock()
+		if !first || at.IsZero() {
+			*at = time.Now()
+		}
+		t.mu.Unlock()
+	}
+	trace := &httptrace.ClientTrace{
+		DNSStart:             func(httptrace.DNSStartInfo) { mark(&t.dnsStart, true) },
+		DNSDone:              func(httptrace.DNSDoneInfo) { mark(&t.dnsDone, false) },
+		ConnectStart:         func(_, _ string) { mark(&t.connStart, true) },
+		ConnectDone:          func(_, _ string, _ error) { mark(&t.connDone, false) },
+		TLSHandshakeStart:    func() { mark(&t.tlsStart, true) },
+		TLSHandshakeDone:     func(tls.ConnectionState, error) { mark(&t.tlsDone, false) },
+		GotFirstResponseByte: func() { mark(&t.firstByte, true) },
+	}
+	return req.WithContext(httptrace.WithClientTrace(req.Context(), trace)), t
+}
+
+// phase returns the duration between two marks;
+// or zero if the phase did not take place.
+func phase(start time.Time, end time.Time) time.Duration {
+	if start.IsZero() || end.IsZero() {
+		return 0
+	}
+	return end.Sub(start)
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d/time.Microsecond) / 1000
+}
+
+// Timed marks the end of a request's transfer, records its
+// total time in the run's Timings and returns a logger that
+// includes the request's phase timings in milliseconds.
+// Requests exceeding the slow threshold are logged as slow.
+// Only pages, GET requested to be filtered for links, are
+// ranked among the slowest; not ranged GET existence checks.
+func (ls *Links) Timed(f FilterType, method string, t *Timing) log.Logger {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	total := time.Since(t.start)
+	ls.timings.Add(ls.Host, ls.String(), f == HTMLFILTER || f == CSSFILTER, total)
+	if ls.timings.slow > 0 && method == "GET" && total > ls.timings.slow {
+		ls.log.Warn("slow", "src", ls.source, "url", ls.String(), "total_ms", ms(total), "threshold_ms", ms(ls.timings.slow))
+	}
+	l := ls.log
+	if ls.reqid != "" {
+		l = l.New("reqid", ls.reqid)
+	}
+	return l.New(
+		"dns_ms", ms(phase(t.dnsStart, t.dnsDone)),
+		"connect_ms", ms(phase(t.connStart, t.connDone)),
+		"tls_ms", ms(phase(t.tlsStart, t.tlsDone)),
+		"ttfb_ms", ms(phase(t.start, t.firstByte)),
+		"total_ms", ms(total))
+}
+
+type timed struct {
+	url   string
+	total time.Duration
+}
+
+// slowPages is a min heap of the slowest pages; so only the
+// number of pages reported is kept, whatever the site size.
+type slowPages []timed
+
+func (sp slowPages) Len() int            { return len(sp) }
+func (sp slowPages) Less(i, j int) bool  { return sp[i].total < sp[j].total }
+func (sp slowPages) Swap(i, j int)       { sp[i], sp[j] = sp[j], sp[i] }
+func (sp *slowPages) Push(x interface{}) { *sp = append(*sp, x.(timed)) }
+func (sp *slowPages) Pop() interface{} {
+	old := *sp
+	x := old[len(old)-1]
+	*sp = old[:len(old)-1]
+	return x
+}
+
+// latencyBuckets is the number of latency histogram buckets;
+// each is latencyGrowth times wider than the previous, from
+// under a millisecond to over ten minutes.
+const latencyBuckets = 160
+
+const latencyGrowth = 1.1
+
+// latency is a fixed size histogram of a host's request times;
+// so that its memory does not grow with the size of the crawl.
+// Percentiles are reported as the upper bound of their bucket,
+// which is within latencyGrowth of the actual request time.
+type latency struct {
+	count   int
+	max     time.Duration
+	buckets [latencyBuckets]int
+}
+
+// bucket returns the histogram bucket of a duration.
+func bucket(d time.Duration) int {
+	if d < time.Millisecond {
+		return 0
+	}
+	i := int(math.Log(float64(d)/float64(time.Millisecond))/math.Log(latencyGrowth)) + 1
+	if i >= latencyBuckets {
+		i = latencyBuckets - 1
+	}
+	return i
+}
+
+func (l *latency) Add(d time.Duration) {
+	l.count++
+	if d > l.max {
+		l.max = d
+	}
+	l.buckets[bucket(d)]++
+}
+
+// Percentile returns the nearest-rank percentile of the request
+// times; the upper bound of its bucket, but never beyond the
+// slowest request.
+func (l *latency) Percentile(p int) time.Duration {
+	rank := (l.count*p + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	seen := 0
+	for i, n := range l.buckets {
+		seen += n
+		if seen >= rank {
+			upper := time.Duration(float64(time.Millisecond) * math.Pow(latencyGrowth, float64(i)))
+			if upper > l.max || i == latencyBuckets-1 {
+				return l.max
+			}
+			return upper
+		}
+	}
+	return l.max
+}
+
+// Timings collects the request time histogram of each host of
+// the run, as well as the slowest html and css pages, so that
+// latency percentiles and the slowest pages may be reported
+// once the crawl completes. It is shared by all threads.
+type Timings struct {
+	mu      sync.Mutex
+	hosts   map[string]*latency
+	pages   slowPages
+	slow    time.Duration
+	slowest int
+}
+
+// NewTimings returns Timings that flag GET requests slower
+// than the slow threshold, when greater than zero, and
+// report the slowest number of pages.
+func NewTimings(slow time.Duration, slowest int) *Timings {
+	return &Timings{hosts: make(map[string]*latency), slow: slow, slowest: slowest}
+}
+
+// Add records the total time of a request; and of a page
+// if it is among the slowest so far.
+func (ts *Timings) Add(host string, url string, page bool, total time.Duration) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	hl, ok := ts.hosts[host]
+	if !ok {
+		hl = &latency{}
+		ts.hosts[host] = hl
+	}
+	hl.Add(total)
+	if !page || ts.slowest <= 0 {
+		return
+	}
+	if len(ts.pages) < ts.slowest {
+		heap.Push(&ts.pages, timed{url: url, total: total})
+	} else if total > ts.pages[0].total {
+		ts.pages[0] = timed{url: url, total: total}
+		heap.Fix(&ts.pages, 0)
+	}
+}
+
+// Report logs the request count and latency percentiles of
+// each host followed by the slowest GET requested pages.
+func (ts *Timings) Report(l log.Logger) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	var hosts []string
+	for host := range ts.hosts {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	for _, host := range hosts {
+		hl := ts.hosts[host]
+		l.Info("host-latency", "host", host, "count", hl.count,
+			"p50_ms", ms(hl.Percentile(50)),
+			"p90_ms", ms(hl.Percentile(90)),
+			"p99_ms", ms(hl.Percentile(99)),
+			"max_ms", ms(hl.max))
+	}
+	pages := append([]timed(nil), ts.pages...)
+	sort.Slice(pages, func(i, j int) bool { return pages[i].total > pages[j].total })
+	for i, p := range pages {
+		l.Info("slowest", "rank", i+1, "url", p.url, "total_ms", ms(p.total), "slow", ts.slow > 0 && p.total > ts.slow)
+	}
+}
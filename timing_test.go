@@ -0,0 +1,106 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Only the slowest pages are kept, and reported slowest first;
+// existence checks are not ranked.
+func TestTimingsSlowest(t *testing.T) {
+	ts := NewTimings(0, 3)
+	for i := 1; i <= 100; i++ {
+		ts.Add("www.txstate.edu", fmt.Sprintf("https://www.txstate.edu/%d", i), true, time.Duration((i*37)%101)*time.Millisecond)
+	}
+	ts.Add("www.txstate.edu", "https://www.txstate.edu/big.pdf", false, time.Second)
+	if len(ts.pages) != 3 {
+		t.Errorf("%d pages kept, want 3", len(ts.pages))
+	}
+	tl := &testLog{}
+	ts.Report(tl.logger())
+	var got []string
+	for _, ctx := range tl.find("slowest") {
+		got = append(got, fmt.Sprintf("%v %v", ctx["url"], ctx["total_ms"]))
+	}
+	want := []string{
+		"https://www.txstate.edu/30 100",
+		"https://www.txstate.edu/60 99",
+		"https://www.txstate.edu/90 98",
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("slowest %v, want %v", got, want)
+	}
+	if latency := tl.find("host-latency"); len(latency) != 1 || latency[0]["count"] != 101 {
+		t.Errorf("host-latency %v, want a count of 101", latency)
+	}
+}
+
+// Percentiles are within the histogram's bucket growth of
+// the actual nearest-rank request times, and never beyond
+// the slowest request.
+func TestLatencyPercentile(t *testing.T) {
+	var l latency
+	for i := 1; i <= 1000; i++ {
+		l.Add(time.Duration(i) * time.Millisecond)
+	}
+	for _, p := range []int{50, 90, 99, 100} {
+		want := time.Duration(p*10) * time.Millisecond
+		got := l.Percentile(p)
+		if got < want || float64(got) > float64(want)*latencyGrowth {
+			t.Errorf("p%d %v, want within %v of %v", p, got, latencyGrowth, want)
+		}
+	}
+	if l.Percentile(100) != time.Second {
+		t.Errorf("p100 %v, want the slowest request of 1s", l.Percentile(100))
+	}
+	l = latency{}
+	l.Add(20 * time.Minute)
+	l.Add(100 * time.Microsecond)
+	if l.Percentile(50) != time.Millisecond || l.Percentile(99) != 20*time.Minute {
+		t.Errorf("p50 %v p99 %v, want 1ms and 20m", l.Percentile(50), l.Percentile(99))
+	}
+}
+
+// The request phases of an https request are timed.
+func TestTimed(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(10 * time.Millisecond)
+		fmt.Fprint(w, "ok")
+	}))
+	defer ts.Close()
+	req, err := http.NewRequest("GET", ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, timing := NewTiming(req)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	tl := &testLog{}
+	ls := testLinks(t, ts.URL)
+	ls.timings = NewTimings(time.Millisecond, 1)
+	ls.log = tl.logger()
+	ls.Timed(HTMLFILTER, "GET", timing).Info("req")
+	reqs := tl.find("req")
+	if len(reqs) != 1 {
+		t.Fatalf("%d req entries, want 1", len(reqs))
+	}
+	for _, key := range []string{"connect_ms", "tls_ms", "ttfb_ms", "total_ms"} {
+		if reqs[0][key].(float64) <= 0 {
+			t.Errorf("%s %v, want a positive time", key, reqs[0][key])
+		}
+	}
+	if reqs[0]["ttfb_ms"].(float64) < 10 {
+		t.Errorf("ttfb_ms %v, want at least the 10ms handler time", reqs[0]["ttfb_ms"])
+	}
+	if len(tl.find("slow")) != 1 {
+		t.Errorf("request slower than 1ms not logged as slow")
+	}
+}
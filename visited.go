@@ -0,0 +1,119 @@
+// Visited url statuses (visited)
+package main
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+// Number of Visited shards; independent of the number of
+// threads so that --threads does not change the layout.
+const visitedShards = 64
+
+type visitedShard struct {
+	mu sync.Mutex
+	// Reports waiting on urls being requested.
+	pending map[string][]func(int)
+}
+
+// Visited records the status code of every url requested. It
+// is shared by all threads, and sharded by url hash to limit
+// lock contention. A url is claimed by the first thread to
+// handle it, and only that thread requests it. The statuses
+// themselves are kept in a VisitedStore.
+type Visited struct {
+	shards []visitedShard
+	store  VisitedStore
+	mu     sync.Mutex
+	err    error
+}
+
+func NewVisited(store VisitedStore) *Visited {
+	v := &Visited{shards: make([]visitedShard, visitedShards), store: store}
+	for i := range v.shards {
+		v.shards[i].pending = make(map[string][]func(int))
+	}
+	return v
+}
+
+func (v *Visited) shard(url string) *visitedShard {
+	h := fnv.New64()
+	h.Write([]byte(url))
+	return &v.shards[h.Sum64()%uint64(len(v.shards))]
+}
+
+// Seed records a seed url, when not crawling, with a status
+// of -1; so that it is parsed by the thread that claims it.
+func (v *Visited) Seed(url string) {
+	s := v.shard(url)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := v.store.Get(url); !ok {
+		v.put(url, -1)
+	}
+}
+
+// put records a status in the store; keeping the first
+// error, to be returned by Close.
+func (v *Visited) put(url string, stat int) {
+	if err := v.store.Put(url, stat); err != nil {
+		v.mu.Lock()
+		if v.err == nil {
+			v.err = err
+		}
+		v.mu.Unlock()
+	}
+}
+
+// Claim returns the status recorded for a url and true if it
+// was already requested. If another thread is still requesting
+// the url, report is called with its status once recorded and
+// pending is returned true. Otherwise the url is claimed by the
+// caller, who must record its status with Set; seeds are
+// claimed with a status of -1.
+func (v *Visited) Claim(url string, report func(int)) (stat int, ok bool, pending bool) {
+	s := v.shard(url)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if reports, ok := s.pending[url]; ok {
+		s.pending[url] = append(reports, report)
+		return 0, true, true
+	}
+	stat, ok = v.store.Get(url)
+	if ok && stat != -1 {
+		return stat, true, false
+	}
+	s.pending[url] = nil
+	return stat, false, false
+}
+
+// Set records the status of a claimed url, and
+// reports it to those waiting on the url.
+func (v *Visited) Set(url string, stat int) {
+	s := v.shard(url)
+	s.mu.Lock()
+	reports := s.pending[url]
+	delete(s.pending, url)
+	v.put(url, stat)
+	s.mu.Unlock()
+	for _, report := range reports {
+		report(stat)
+	}
+}
+
+// Status returns the status code recorded for a url.
+func (v *Visited) Status(url string) (int, bool) {
+	return v.store.Get(url)
+}
+
+// Close closes the store; returning the first error
+// recording a status, if any.
+func (v *Visited) Close() error {
+	err := v.store.Close()
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.err != nil {
+		return v.err
+	}
+	return err
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// testStores returns a store of each kind.
+func testStores(t *testing.T, dir string) map[string]VisitedStore {
+	stores := make(map[string]VisitedStore)
+	for _, spec := range []string{"map", "hash", "disk:" + filepath.Join(dir, "visited.db"), "bloom:hash", "bloom:disk:" + filepath.Join(dir, "bloom.db")} {
+		store, err := NewVisitedStore(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stores[spec] = store
+	}
+	return stores
+}
+
+func TestVisitedClaim(t *testing.T) {
+	dir, err := ioutil.TempDir("", "thrawler-visited-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for spec, store := range testStores(t, dir) {
+		v := NewVisited(store)
+		url := "https://www.txstate.edu/"
+		if stat, ok, pending := v.Claim(url, nil); stat != 0 || ok || pending {
+			t.Errorf("%s: first claim %d, %v, %v", spec, stat, ok, pending)
+		}
+		var reported []int
+		for i := 0; i < 2; i++ {
+			if _, ok, pending := v.Claim(url, func(stat int) { reported = append(reported, stat) }); !ok || !pending {
+				t.Errorf("%s: claim of a pending url %v, %v", spec, ok, pending)
+			}
+		}
+		if len(reported) != 0 {
+			t.Errorf("%s: reported %v before Set", spec, reported)
+		}
+		v.Set(url, 404)
+		if fmt.Sprint(reported) != "[404 404]" {
+			t.Errorf("%s: reported %v, want [404 404]", spec, reported)
+		}
+		if stat, ok, pending := v.Claim(url, nil); stat != 404 || !ok || pending {
+			t.Errorf("%s: claim of a visited url %d, %v, %v", spec, stat, ok, pending)
+		}
+		// Seeds are claimed with a status of -1, once.
+		seed := "https://www.txstate.edu/seed"
+		v.Seed(seed)
+		if stat, ok, pending := v.Claim(seed, nil); stat != -1 || ok || pending {
+			t.Errorf("%s: seed claim %d, %v, %v", spec, stat, ok, pending)
+		}
+		if _, _, pending := v.Claim(seed, func(int) {}); !pending {
+			t.Errorf("%s: claimed seed not pending", spec)
+		}
+		v.Set(seed, 200)
+		if stat, ok := v.Status(seed); stat != 200 || !ok {
+			t.Errorf("%s: seed status %d, %v", spec, stat, ok)
+		}
+		if _, ok := v.Status("https://www.txstate.edu/never"); ok {
+			t.Errorf("%s: status of an unvisited url", spec)
+		}
+		if err := v.Close(); err != nil {
+			t.Errorf("%s: %v", spec, err)
+		}
+	}
+}
+
+// Of many threads claiming a url at once, only one claims it;
+// the others are all reported its status.
+func TestVisitedClaimConcurrent(t *testing.T) {
+	store, err := NewVisitedStore("map")
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := NewVisited(store)
+	var mu sync.Mutex
+	claims := make(map[string]int)
+	reports := make(map[string]int)
+	var wg sync.WaitGroup
+	for i := 0; i < 32; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for u := 0; u < 100; u++ {
+				url := fmt.Sprintf("https://www.txstate.edu/%d", u)
+				_, ok, pending := v.Claim(url, func(stat int) {
+					mu.Lock()
+					reports[url]++
+					mu.Unlock()
+				})
+				if !ok && !pending {
+					mu.Lock()
+					claims[url]++
+					mu.Unlock()
+					v.Set(url, 200)
+				} else if ok && !pending {
+					mu.Lock()
+					reports[url]++
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	for u := 0; u < 100; u++ {
+		url := fmt.Sprintf("https://www.txstate.edu/%d", u)
+		if claims[url] != 1 || reports[url] != 31 {
+			t.Errorf("%s: %d claims and %d reports, want 1 and 31", url, claims[url], reports[url])
+		}
+	}
+}
@@ -0,0 +1,192 @@
+// Page weight budgets (weight)
+package main
+
+import (
+	"fmt"
+	log "gopkg.in/inconshreveable/log15.v2"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type ErrByteSize struct {
+	size string
+}
+
+func (e ErrByteSize) Error() string {
+	return fmt.Sprintf("Invalid byte size: '%s'", e.size)
+}
+
+type Budget struct {
+	url    *regexp.Regexp
+	metric string
+	limit  int64
+}
+
+// Budgets is the list of page weight limits of html pages
+// whose url matches the budget's url regular expression.
+// They are declared in the [budget] section of the config
+// file as tab delimited url regexp, metric and limit
+// entries, where metric is one of:
+//   total	bytes of the page and all of its subresources
+//   images	bytes of the page's image subresources
+//   count	number of the page's subresources
+// Byte limits may use a K, M or G suffix; e.g. 2M.
+type Budgets []Budget
+
+func (bs *Budgets) Parse(fields []string) error {
+	if len(fields) != 3 {
+		return ErrConfigFile{line: strings.Join(fields, "\t")}
+	}
+	url, err := regexp.Compile(fields[0])
+	if err != nil {
+		return err
+	}
+	var limit int64
+	switch fields[1] {
+	case "total", "images":
+		limit, err = parseBytes(fields[2])
+	case "count":
+		limit, err = strconv.ParseInt(fields[2], 10, 64)
+		if err == nil && limit < 0 {
+			return ErrConfigFile{line: strings.Join(fields, "\t")}
+		}
+	default:
+		return ErrConfigFile{line: strings.Join(fields, "\t")}
+	}
+	if err != nil {
+		return err
+	}
+	*bs = append(*bs, Budget{url: url, metric: fields[1], limit: limit})
+	return nil
+}
+
+// parseBytes parses a byte count with an optional K, M or G
+// (or KB, MB, GB) suffix using multiples of 1024. Negative
+// sizes and sizes overflowing an int64 are rejected.
+func parseBytes(size string) (int64, error) {
+	s := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(size)), "B")
+	var mult int64 = 1
+	switch {
+	case strings.HasSuffix(s, "K"):
+		mult = 1 << 10
+	case strings.HasSuffix(s, "M"):
+		mult = 1 << 20
+	case strings.HasSuffix(s, "G"):
+		mult = 1 << 30
+	}
+	if mult > 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 || n > math.MaxInt64/mult {
+		return 0, ErrByteSize{size: size}
+	}
+	return n * mult, nil
+}
+
+// Weights records the size of every requested resource and
+// the subresources referenced by each page; so that page
+// weights may be totaled and checked against budgets once
+// the crawl completes. Subresources are recorded by url, as
+// a resource shared by many pages is only requested once.
+// It is shared by all threads; a nil Weights records nothing.
+type Weights struct {
+	mu      sync.Mutex
+	budgets Budgets
+	sizes   map[string]int64
+	images  map[string]bool
+	links   map[string]map[string]bool
+	pages   []string
+}
+
+// NewWeights returns nil if there are no budgets to check.
+func NewWeights(budgets Budgets) *Weights {
+	if len(budgets) == 0 {
+		return nil
+	}
+	return &Weights{
+		budgets: budgets,
+		sizes:   make(map[string]int64),
+		images:  make(map[string]bool),
+		links:   make(map[string]map[string]bool),
+	}
+}
+
+// Page records an html page to be checked against budgets.
+func (w *Weights) Page(url string) {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	w.pages = append(w.pages, url)
+	w.mu.Unlock()
+}
+
+// Link records a subresource referenced by a page or stylesheet.
+func (w *Weights) Link(src string, url string) {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	if w.links[src] == nil {
+		w.links[src] = make(map[string]bool)
+	}
+	w.links[src][url] = true
+	w.mu.Unlock()
+}
+
+// Size records the byte count and content type of a resource.
+// Unknown sizes, such as HEAD responses without a
+// Content-Length header, should be recorded as zero.
+func (w *Weights) Size(url string, size int64, content string) {
+	if w == nil {
+		return
+	}
+	if size < 0 {
+		size = 0
+	}
+	w.mu.Lock()
+	w.sizes[url] = size
+	w.images[url] = strings.HasPrefix(content, "image/")
+	w.mu.Unlock()
+}
+
+// Report logs an over-budget entry for each page
+// metric that exceeds a matching budget's limit.
+func (w *Weights) Report(l log.Logger) {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, page := range w.pages {
+		metrics := map[string]int64{"total": w.sizes[page]}
+		seen := map[string]bool{page: true}
+		w.weigh(page, seen, metrics)
+		for _, b := range w.budgets {
+			if b.url.MatchString(page) && metrics[b.metric] > b.limit {
+				l.Warn("over-budget", "url", page, "metric", b.metric, "value", metrics[b.metric], "limit", b.limit)
+			}
+		}
+	}
+}
+
+// weigh adds the subresources of src, and in turn their own
+// subresources such as stylesheet images, to the metrics.
+func (w *Weights) weigh(src string, seen map[string]bool, metrics map[string]int64) {
+	for url := range w.links[src] {
+		if seen[url] {
+			continue
+		}
+		seen[url] = true
+		metrics["total"] += w.sizes[url]
+		metrics["count"]++
+		if w.images[url] {
+			metrics["images"] += w.sizes[url]
+		}
+		w.weigh(url, seen, metrics)
+	}
+}
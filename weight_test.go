@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestParseBytes(t *testing.T) {
+	for _, test := range []struct {
+		size string
+		want int64
+		err  bool
+	}{
+		{"512", 512, false},
+		{"2K", 2 << 10, false},
+		{"3mb", 3 << 20, false},
+		{" 1G ", 1 << 30, false},
+		{"8589934591G", 8589934591 << 30, false},
+		{"-5M", 0, true},
+		{"9999999999G", 0, true},
+		{"99999999999999999999", 0, true},
+		{"M", 0, true},
+		{"2T", 0, true},
+	} {
+		got, err := parseBytes(test.size)
+		if (err != nil) != test.err || got != test.want {
+			t.Errorf("parseBytes(%q) = %d, %v; want %d, error %t", test.size, got, err, test.want, test.err)
+		}
+	}
+}
+
+func TestBudgetsParse(t *testing.T) {
+	for _, test := range []struct {
+		line  string
+		limit int64
+		err   bool
+	}{
+		{".\ttotal\t3M", 3 << 20, false},
+		{".\timages\t2M", 2 << 20, false},
+		{".\tcount\t100", 100, false},
+		{".\tcount\t-1", 0, true},
+		{".\tcount\t2M", 0, true},
+		{".\ttotal\t-5M", 0, true},
+		{".\tweight\t3M", 0, true},
+		{"(\ttotal\t3M", 0, true},
+		{".\ttotal", 0, true},
+	} {
+		var bs Budgets
+		err := bs.Parse(strings.Split(test.line, "\t"))
+		if (err != nil) != test.err {
+			t.Errorf("%q: error %v, want error %t", test.line, err, test.err)
+		} else if err == nil && (len(bs) != 1 || bs[0].limit != test.limit) {
+			t.Errorf("%q: budgets %v, want a limit of %d", test.line, bs, test.limit)
+		}
+	}
+}
+
+// overBudget returns the over-budget entries by metric
+// and url, with their value.
+func overBudget(w *Weights) map[string]int64 {
+	tl := &testLog{}
+	w.Report(tl.logger())
+	found := make(map[string]int64)
+	for _, ctx := range tl.find("over-budget") {
+		found[fmt.Sprintf("%v %v", ctx["metric"], ctx["url"])] = ctx["value"].(int64)
+	}
+	return found
+}
+
+// A page's weight includes its subresources, and in turn
+// their own, each counted once however often referenced.
+func TestWeightsReport(t *testing.T) {
+	w := NewWeights(Budgets{
+		{url: regexp.MustCompile(`/page$`), metric: "total", limit: 0},
+		{url: regexp.MustCompile(`/page$`), metric: "images", limit: 0},
+		{url: regexp.MustCompile(`.`), metric: "count", limit: 2},
+	})
+	w.Page("/page")
+	w.Size("/page", 100, "text/html")
+	w.Link("/page", "/a.png")
+	w.Link("/page", "/s.css")
+	w.Link("/page", "/a.png")
+	w.Link("/s.css", "/b.png")
+	w.Link("/s.css", "/a.png")
+	w.Size("/a.png", 1000, "image/png")
+	w.Size("/s.css", 50, "text/css")
+	w.Size("/b.png", 2000, "image/png")
+	w.Page("/light")
+	w.Size("/light", 10, "text/html")
+	w.Link("/light", "/x.js")
+	w.Size("/x.js", -1, "application/javascript")
+	want := map[string]int64{
+		"total /page":  3150,
+		"images /page": 3000,
+		"count /page":  3,
+	}
+	if got := overBudget(w); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("over-budget %v, want %v", got, want)
+	}
+}
+
+// Without budgets, no weights are recorded.
+func TestWeightsNil(t *testing.T) {
+	w := NewWeights(nil)
+	if w != nil {
+		t.Fatalf("NewWeights(nil) = %v, want nil", w)
+	}
+	w.Page("/page")
+	w.Link("/page", "/a.png")
+	w.Size("/a.png", 1000, "image/png")
+	w.Report(discardLog())
+}
+
+// The subresources of a crawled page are weighed,
+// whether requested by HEAD or filtered stylesheets.
+func TestWeightsCrawl(t *testing.T) {
+	page := `<html><body>
+<link rel="stylesheet" type="text/css" href="/s.css">
+<script src="/x.js"></script>
+<img src="/a.png">
+<a href="/other">other</a>
+</body></html>`
+	css := `body { background: url(/b.png); }`
+	sizes := map[string]int{"/a.png": 1000, "/b.png": 2000, "/x.js": 500}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/", "/other":
+			w.Header().Set("Content-Type", "text/html")
+			fmt.Fprint(w, page)
+		case "/s.css":
+			w.Header().Set("Content-Type", "text/css")
+			fmt.Fprint(w, css)
+		default:
+			size, ok := sizes[r.URL.Path]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			if strings.HasSuffix(r.URL.Path, ".png") {
+				w.Header().Set("Content-Type", "image/png")
+			} else {
+				w.Header().Set("Content-Type", "application/javascript")
+			}
+			w.Header().Set("Content-Length", fmt.Sprint(size))
+			if r.Method != "HEAD" {
+				w.Write(make([]byte, size))
+			}
+		}
+	}))
+	defer ts.Close()
+	envs := testEnvs(t, regexp.QuoteMeta(ts.URL))
+	root := regexp.MustCompile(`^` + regexp.QuoteMeta(ts.URL) + `/$`)
+	envs.weights = NewWeights(Budgets{
+		{url: root, metric: "total", limit: 0},
+		{url: root, metric: "images", limit: 0},
+		{url: root, metric: "count", limit: 0},
+	})
+	testCrawl(envs, 2, ts.URL+"/")
+	want := map[string]int64{
+		"total " + ts.URL + "/":  int64(len(page) + len(css) + 3500),
+		"images " + ts.URL + "/": 3000,
+		"count " + ts.URL + "/":  4,
+	}
+	if got := overBudget(envs.weights); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("over-budget %v, want %v", got, want)
+	}
+}